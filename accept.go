@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AcceptHook is called with every WebSocket request before it is upgraded.
+// It decides whether to accept the connection and may pick its ID; an empty
+// ID gets a generated one. Returning an *AcceptError rejects the request
+// with that status, any other error with a 500.
+type AcceptHook func(r *http.Request) (accept bool, connID string, err error)
+
+// AcceptError rejects a connection from an AcceptHook with a specific status
+type AcceptError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *AcceptError) Error() string {
+	return e.Message
+}
+
+// maxAcceptDecisionBytes caps the size of an accept webhook's answer
+const maxAcceptDecisionBytes = 64 * 1024
+
+// AcceptRequest describes a WebSocket request to an accept webhook
+type AcceptRequest struct {
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Header     http.Header `json:"header"`
+}
+
+// AcceptDecision is an accept webhook's answer, given with a 200 status.
+// A refusal with an error Status is passed on to the client along with
+// Code and Message.
+type AcceptDecision struct {
+	Accept  bool   `json:"accept"`
+	ConnID  string `json:"connId,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// WebhookAcceptHook returns an AcceptHook that leaves the decision to the
+// webhook at url. Connections are refused when the webhook fails or does
+// not answer within timeout.
+func WebhookAcceptHook(url string, timeout time.Duration) AcceptHook {
+	client := &http.Client{Timeout: timeout}
+	return func(r *http.Request) (bool, string, error) {
+		body, err := json.Marshal(AcceptRequest{URL: r.URL.String(), RemoteAddr: r.RemoteAddr, Header: r.Header})
+		if err != nil {
+			return false, "", err
+		}
+		request, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return false, "", err
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(request)
+		if err != nil {
+			return false, "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false, "", fmt.Errorf("accept webhook answered %s", resp.Status)
+		}
+
+		var decision AcceptDecision
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxAcceptDecisionBytes)).Decode(&decision); err != nil {
+			return false, "", fmt.Errorf("accept webhook answer: %w", err)
+		}
+		if !decision.Accept && decision.Status >= 400 && decision.Status <= 599 {
+			return false, "", &AcceptError{Status: decision.Status, Code: decision.Code, Message: decision.Message}
+		}
+		return decision.Accept, decision.ConnID, nil
+	}
+}
+
+// acceptConnection refuses connections under hard memory pressure or past the
+// connection limit, then runs the accept hook, if any, and returns the ID for
+// the new connection. A client resuming a recent connection gets that
+// connection's ID and state back instead. When the connection is refused it
+// has already responded to the request and returns false.
+func (ws *WebSocketServer) acceptConnection(w http.ResponseWriter, r *http.Request) (string, *resumeState, bool) {
+	id, ok := ws.admitConnection(w, r)
+	if !ok {
+		return "", nil, false
+	}
+	if resumed, ok := ws.resumeFor(r.URL.Query().Get("resume")); ok {
+		return resumed.id, resumed, true
+	}
+	return id, nil, true
+}
+
+// admitConnection decides whether to accept a connection and picks its ID.
+// At the connection limit it is refused unless the eviction policy makes
+// room for it.
+func (ws *WebSocketServer) admitConnection(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if ws.memoryPressure.Load() == memoryPressureHard {
+		httpError(w, http.StatusServiceUnavailable, "overloaded", "server is low on memory, try again later")
+		return "", false
+	}
+	if ws.opts.MaxConnections > 0 && ws.connectionManager.Count() >= ws.opts.MaxConnections && !ws.evictForCapacity() {
+		ws.metrics.connectionsRejected.Add(1)
+		httpError(w, http.StatusServiceUnavailable, "too_many_connections", "connection limit reached, try again later")
+		return "", false
+	}
+
+	if ws.opts.AcceptHook == nil {
+		return uuid.New().String(), true
+	}
+
+	accept, id, err := ws.opts.AcceptHook(r)
+	if err != nil {
+		var acceptErr *AcceptError
+		if errors.As(err, &acceptErr) {
+			httpError(w, acceptErr.Status, acceptErr.Code, acceptErr.Message)
+			return "", false
+		}
+		log.Printf("❌ Accept hook failed: %v\n", err)
+		httpError(w, http.StatusInternalServerError, "accept_failed", "could not accept the connection")
+		return "", false
+	}
+	if !accept {
+		httpError(w, http.StatusForbidden, "forbidden", "connection refused")
+		return "", false
+	}
+
+	if id == "" {
+		return uuid.New().String(), true
+	}
+	if _, exists := ws.connectionManager.Get(id); exists {
+		httpError(w, http.StatusConflict, "id_in_use", "a connection with this ID already exists")
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAcceptHookRejectsByHeader(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{AcceptHook: func(r *http.Request) (bool, string, error) {
+		switch r.Header.Get("X-Api-Key") {
+		case "":
+			return false, "", &AcceptError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "missing API key"}
+		case "banned":
+			return false, "", nil
+		}
+		return true, "", nil
+	}}))
+
+	for _, test := range []struct {
+		key    string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"banned", http.StatusForbidden},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), http.Header{"X-Api-Key": {test.key}})
+		if err == nil || resp == nil || resp.StatusCode != test.status {
+			t.Fatalf("key %q: got %v, want status %d", test.key, resp, test.status)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), http.Header{"X-Api-Key": {"good"}})
+	if err != nil {
+		t.Fatalf("accepted key refused: %v", err)
+	}
+	defer conn.Close()
+	if id, _ := newTestClient(t, conn).readType("welcome")["userId"].(string); id == "" {
+		t.Fatalf("no generated ID for an accepted connection")
+	}
+}
+
+func TestAcceptHookAssignsID(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{AcceptHook: func(r *http.Request) (bool, string, error) {
+		return true, "user-" + r.URL.Query().Get("user"), nil
+	}}))
+	a := dial(t, srv, "/ws?user=alice")
+	b := dial(t, srv, "/ws?user=bob")
+	if a.id != "user-alice" || b.id != "user-bob" {
+		t.Fatalf("connections got IDs %s and %s", a.id, b.id)
+	}
+
+	b.send(map[string]string{"signalType": "candidate", "userId": "user-alice", "candidate": "c"})
+	if message := a.readType("candidate"); message["userId"] != "user-bob" {
+		t.Fatalf("candidate from %v", message["userId"])
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws?user=alice"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("second connection with an ID in use: %v", resp)
+	}
+}
+
+func TestAcceptWebhook(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request AcceptRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("webhook got %v", err)
+		}
+		switch request.Header.Get("X-Api-Key") {
+		case "good":
+			json.NewEncoder(w).Encode(AcceptDecision{Accept: true, ConnID: "user-alice"})
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(AcceptDecision{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "bad API key"})
+		}
+	}))
+	defer webhook.Close()
+	srv := startServer(t, NewWebSocketServer(Options{AcceptWebhook: webhook.URL}))
+
+	for _, test := range []struct {
+		key    string
+		status int
+	}{
+		{"bad", http.StatusUnauthorized},
+		{"broken", http.StatusInternalServerError},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), http.Header{"X-Api-Key": {test.key}})
+		if err == nil || resp == nil || resp.StatusCode != test.status {
+			t.Fatalf("key %q: got %v, want status %d", test.key, resp, test.status)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), http.Header{"X-Api-Key": {"good"}})
+	if err != nil {
+		t.Fatalf("accepted key refused: %v", err)
+	}
+	defer conn.Close()
+	if id := newTestClient(t, conn).readType("welcome")["userId"]; id != "user-alice" {
+		t.Fatalf("connection got ID %v", id)
+	}
+}
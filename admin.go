@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces secrets in admin output
+const redactedValue = "[redacted]"
+
+// requireAdmin wraps an admin handler with bearer token authentication. Admin
+// endpoints do not exist unless an admin token is configured.
+func (ws *WebSocketServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ws.opts.AdminToken == "" {
+			httpError(w, http.StatusNotFound, "not_found", "no such endpoint")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ws.opts.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminNotFound answers requests for admin endpoints that do not exist
+func (ws *WebSocketServer) handleAdminNotFound(w http.ResponseWriter, r *http.Request) {
+	httpError(w, http.StatusNotFound, "not_found", "no such admin endpoint")
+}
+
+// handleAdminConfig returns the effective configuration with secrets redacted
+func (ws *WebSocketServer) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, sanitizedOptions(ws.opts))
+}
+
+// SlowClient describes a connection flagged as slow to drain its queue
+type SlowClient struct {
+	ID            string  `json:"id"`
+	QueueDepth    int     `json:"queueDepth"`
+	QueueDepthAvg float64 `json:"queueDepthAvg"`
+}
+
+// handleAdminSlowClients lists the connections currently flagged as slow
+func (ws *WebSocketServer) handleAdminSlowClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	slowClients := []SlowClient{}
+	for _, client := range ws.connectionManager.All() {
+		if client.Slow() {
+			slowClients = append(slowClients, SlowClient{
+				ID:            client.ID(),
+				QueueDepth:    client.QueueDepth(),
+				QueueDepthAvg: client.QueueDepthAvg(),
+			})
+		}
+	}
+	writeJSON(w, slowClients)
+}
+
+// ConnectionInfo describes an open connection
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	Room        string    `json:"room,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastActive  time.Time `json:"lastActive"`
+	AgeSeconds  float64   `json:"ageSeconds"`
+	IdleSeconds float64   `json:"idleSeconds"`
+}
+
+// handleAdminConnections lists the open connections with their age and how
+// long they have been idle, least recently active first, which is the order
+// evict-lru evicts them in
+func (ws *WebSocketServer) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	now := time.Now()
+	connections := []ConnectionInfo{}
+	for _, client := range ws.connectionManager.All() {
+		room, _ := ws.roomManager.RoomOf(client.ID())
+		lastActive := client.LastActive()
+		connections = append(connections, ConnectionInfo{
+			ID:          client.ID(),
+			Room:        room,
+			ConnectedAt: client.connectedAt,
+			LastActive:  lastActive,
+			AgeSeconds:  now.Sub(client.connectedAt).Seconds(),
+			IdleSeconds: now.Sub(lastActive).Seconds(),
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].LastActive.Before(connections[j].LastActive)
+	})
+	writeJSON(w, connections)
+}
+
+// sanitizedOptions renders Options as a JSON-friendly map keyed by each
+// field's json tag. Fields tagged redact:"true" are masked when set, and
+// durations are shown in their string form.
+func sanitizedOptions(opts Options) map[string]interface{} {
+	config := make(map[string]interface{})
+
+	value := reflect.ValueOf(opts)
+	fields := value.Type()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		switch {
+		case field.Tag.Get("redact") == "true":
+			if !fieldValue.IsZero() {
+				config[name] = redactedValue
+			} else {
+				config[name] = ""
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			config[name] = time.Duration(fieldValue.Int()).String()
+		default:
+			config[name] = fieldValue.Interface()
+		}
+	}
+
+	return config
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("❌ Failed to write response: %v\n", err)
+	}
+}
+
+// HTTPError is the body of every error response from the HTTP endpoints,
+// mirroring the error signal sent over WebSockets
+type HTTPError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// httpError sends a JSON error response with the given status
+func httpError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(HTTPError{Error: code, Message: message}); err != nil {
+		log.Printf("❌ Failed to write response: %v\n", err)
+	}
+}
+
+// methodNotAllowed rejects a request made with the wrong method
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	httpError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getJSON makes a GET request, with a bearer token unless it is empty, and
+// decodes the JSON response into v
+func getJSON(t *testing.T, srv *httptest.Server, path string, token string, v interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("GET %s: %v: %s", path, err, body)
+		}
+	}
+	return resp
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{AdminToken: "tok", IdentitySecret: "hmac-key", DedupWindow: 3}))
+
+	var config map[string]interface{}
+	if resp := getJSON(t, srv, "/admin/config", "tok", &config); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	for _, secret := range []string{"adminToken", "identitySecret"} {
+		if config[secret] != redactedValue {
+			t.Fatalf("%s is %v, want it redacted", secret, config[secret])
+		}
+	}
+	if config["dedupWindow"] != 3.0 || config["sendQueueSize"] == nil {
+		t.Fatalf("config is missing settings: %v", config)
+	}
+	if _, ok := config["acceptHook"]; ok {
+		t.Fatalf("config includes fields that are not settings")
+	}
+}
+
+func TestAdminConfigRequiresToken(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{AdminToken: "tok"}))
+	for _, token := range []string{"", "wrong"} {
+		if resp := getJSON(t, srv, "/admin/config", token, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("token %q: status %d", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPErrorsAreJSON(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{AdminToken: "tok"}))
+	tests := []struct {
+		path   string
+		token  string
+		status int
+		code   string
+	}{
+		{"/admin/config", "", http.StatusUnauthorized, "unauthorized"},
+		{"/admin/nope", "", http.StatusUnauthorized, "unauthorized"},
+		{"/admin/nope", "tok", http.StatusNotFound, "not_found"},
+		{"/nope", "", http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		var body HTTPError
+		resp := getJSON(t, srv, test.path, test.token, &body)
+		if resp.StatusCode != test.status || body.Error != test.code || body.Message == "" {
+			t.Errorf("GET %s: %d %+v, want %d %s", test.path, resp.StatusCode, body, test.status, test.code)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("GET %s: Content-Type %s", test.path, contentType)
+		}
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	var body HTTPError
+	if resp := getJSON(t, srv, "/admin/config", "", &body); resp.StatusCode != http.StatusNotFound || body.Error != "not_found" {
+		t.Fatalf("status %d %+v", resp.StatusCode, body)
+	}
+}
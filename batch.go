@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// CandidateBatch is sent in place of the individual "candidate" signals
+// forwarded to a client within one batch window, in the order they arrived
+type CandidateBatch struct {
+	SignalType string            `json:"signalType"`
+	Candidates []json.RawMessage `json:"candidates"`
+}
+
+// candidateBatcher collects the candidates forwarded to one client and
+// hands them to flush as a single message once the window since the first
+// of them has passed or the batch is full
+type candidateBatcher struct {
+	window  time.Duration
+	maxSize int
+	flush   func(data []byte, count int)
+
+	pending []json.RawMessage
+	timer   *time.Timer
+	mutex   sync.Mutex
+}
+
+// newCandidateBatcher creates a batcher delivering batches to flush
+func newCandidateBatcher(window time.Duration, maxSize int, flush func(data []byte, count int)) *candidateBatcher {
+	return &candidateBatcher{window: window, maxSize: maxSize, flush: flush}
+}
+
+// Add queues an encoded candidate signal for the next batch
+func (b *candidateBatcher) Add(data []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.pending = append(b.pending, data)
+	if len(b.pending) >= b.maxSize {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.Flush)
+	}
+}
+
+// Flush delivers the pending candidates right away. Other signals for the
+// client flush first so that they never overtake candidates sent before them.
+func (b *candidateBatcher) Flush() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked delivers the pending candidates, as a plain signal if there is
+// only one. Callers must hold the lock.
+func (b *candidateBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	pending := b.pending
+	b.pending = nil
+
+	switch len(pending) {
+	case 0:
+		return
+	case 1:
+		b.flush(pending[0], 1)
+		return
+	}
+
+	data, err := json.Marshal(CandidateBatch{SignalType: "candidates", Candidates: pending})
+	if err != nil {
+		log.Printf("❌ Failed to encode candidate batch: %v\n", err)
+		return
+	}
+	b.flush(data, len(pending))
+}
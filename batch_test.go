@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// batchedCandidates returns the candidates a "candidates" batch holds
+func batchedCandidates(t *testing.T, message map[string]interface{}) []string {
+	t.Helper()
+	if message["signalType"] != "candidates" {
+		t.Fatalf("got %v, want a batch", message)
+	}
+	var candidates []string
+	for _, signal := range message["candidates"].([]interface{}) {
+		candidates = append(candidates, signal.(map[string]interface{})["candidate"].(string))
+	}
+	return candidates
+}
+
+func TestCandidatesBatchedWithinWindow(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{CandidateBatchWindow: 100 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	for _, candidate := range []string{"1", "2", "3"} {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+	}
+	if candidates := batchedCandidates(t, b.read()); len(candidates) != 3 || candidates[0] != "1" || candidates[2] != "3" {
+		t.Fatalf("batch %v, want candidates 1 to 3 in order", candidates)
+	}
+
+	// A lone candidate goes out as a plain signal
+	a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "4"})
+	if message := b.read(); message["signalType"] != "candidate" || message["candidate"] != "4" {
+		t.Fatalf("got %v", message)
+	}
+}
+
+func TestCandidateBatchSize(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{CandidateBatchWindow: time.Minute, CandidateBatchSize: 2}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	for _, candidate := range []string{"1", "2", "3"} {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+	}
+	if candidates := batchedCandidates(t, b.read()); len(candidates) != 2 {
+		t.Fatalf("batch %v, want a full batch of 2", candidates)
+	}
+
+	// Other signals flush the pending candidates so as not to overtake them
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA=="})
+	if message := b.read(); message["candidate"] != "3" {
+		t.Fatalf("got %v, want the pending candidate", message)
+	}
+	b.readType("offer")
+}
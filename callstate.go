@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Call states carried by "call-state" signals
+var callStates = map[string]bool{
+	"ringing":  true,
+	"accepted": true,
+	"rejected": true,
+	"ended":    true,
+}
+
+// SignalMessageCallState represents "call-state" signals, which tell a peer
+// where a call is in its lifecycle. CallID and Reason are the application's
+// and forwarded unchanged.
+type SignalMessageCallState struct {
+	SignalEnvelope
+	State  string `json:"state"`
+	CallID string `json:"callId,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// CallStateEvent tells the rest of a room that a call between two of its
+// members changed state
+type CallStateEvent struct {
+	SignalType string `json:"signalType"`
+	Room       string `json:"room"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	State      string `json:"state"`
+	CallID     string `json:"callId,omitempty"`
+}
+
+// forwardCallState relays a "call-state" signal and, with NotifyCallState,
+// tells the room the sender shares with each target it reached about it.
+// It returns the targets reached.
+func (ws *WebSocketServer) forwardCallState(ctx context.Context, client *Client, message []byte) []*Client {
+	var messageJson SignalMessageCallState
+	json.Unmarshal(message, &messageJson)
+	if !callStates[messageJson.State] {
+		ws.sendError(client, errInvalidCallState)
+		return nil
+	}
+
+	forwarded := ws.forwardSignal(ctx, client, &messageJson.SignalEnvelope, &messageJson)
+	if !ws.opts.NotifyCallState {
+		return forwarded
+	}
+	for _, target := range forwarded {
+		room := ws.sharedRoom(client.ID(), target.ID())
+		if room == "" {
+			continue
+		}
+		ws.broadcastToRoom(room, client.ID(), CallStateEvent{
+			SignalType: "call_state_changed",
+			Room:       room,
+			From:       client.ID(),
+			To:         target.ID(),
+			State:      messageJson.State,
+			CallID:     messageJson.CallID,
+		})
+	}
+	return forwarded
+}
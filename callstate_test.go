@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallStateRelayed(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	for _, state := range []string{"ringing", "accepted", "rejected", "ended"} {
+		a.send(map[string]string{"signalType": "call-state", "userId": b.id, "state": state, "callId": "call-1", "reason": "busy"})
+		message := b.readType("call-state")
+		if message["userId"] != a.id || message["state"] != state || message["callId"] != "call-1" || message["reason"] != "busy" {
+			t.Fatalf("relayed %v for state %s", message, state)
+		}
+	}
+
+	a.send(map[string]string{"signalType": "call-state", "userId": b.id, "state": "on-hold"})
+	a.readError("invalid_call_state")
+	b.expectNone(50 * time.Millisecond)
+}
+
+func TestCallStateNotifiesRoom(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{NotifyCallState: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	outsider := dial(t, srv, "/ws")
+	joinAll("r", a, b, c)
+
+	a.send(map[string]string{"signalType": "call-state", "userId": b.id, "state": "ringing", "callId": "call-1"})
+	b.readType("call-state")
+	event := c.readType("call_state_changed")
+	if event["room"] != "r" || event["from"] != a.id || event["to"] != b.id || event["state"] != "ringing" || event["callId"] != "call-1" {
+		t.Fatalf("room told %v", event)
+	}
+
+	// Calls outside a shared room are nobody else's business
+	a.send(map[string]string{"signalType": "call-state", "userId": outsider.id, "state": "ringing"})
+	outsider.readType("call-state")
+	c.expectNone(100 * time.Millisecond)
+}
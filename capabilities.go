@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+)
+
+// CapabilitiesMessage represents a "capabilities" request, in which a client
+// advertises the codecs it can receive (as a=rtpmap encoding names). It is
+// confirmed with "capabilities_updated".
+type CapabilitiesMessage struct {
+	SignalType string   `json:"signalType"`
+	Codecs     []string `json:"codecs"`
+}
+
+// setCapabilities records what a client can receive. An empty list takes
+// back an earlier advertisement.
+func (ws *WebSocketServer) setCapabilities(client *Client, message *CapabilitiesMessage) {
+	if len(message.Codecs) == 0 {
+		client.codecs.Store(nil)
+	} else {
+		codecs := append([]string(nil), message.Codecs...)
+		client.codecs.Store(&codecs)
+	}
+
+	confirmation := CapabilitiesMessage{SignalType: "capabilities_updated", Codecs: message.Codecs}
+	if err := client.WriteJSON(confirmation); err != nil {
+		log.Printf("❌ Failed to confirm capabilities: %v\n", err)
+	}
+}
+
+// adaptSDP removes the codecs a target has not advertised from an encoded
+// SDP. RTX is kept for the codecs that remain, and media sections left
+// with no codec the target supports are rejected. SDP for targets that
+// have not advertised capabilities, or that is too large or fails to
+// decode, is left as is.
+func (ws *WebSocketServer) adaptSDP(encoded string, target *Client) string {
+	supported := target.codecs.Load()
+	if supported == nil {
+		return encoded
+	}
+	if ws.opts.SDPValidationMaxBytes > 0 && len(encoded) > ws.opts.SDPValidationMaxBytes {
+		return encoded
+	}
+	sdp, err := decodeSDP(encoded)
+	if err != nil {
+		return encoded
+	}
+
+	session := parseSDP(sdp)
+	var unsupported []string
+	for _, codec := range session.Codecs() {
+		if strings.EqualFold(codec, "rtx") || containsFold(*supported, codec) {
+			continue
+		}
+		unsupported = append(unsupported, codec)
+	}
+	if len(unsupported) == 0 {
+		return encoded
+	}
+	session.RemoveCodecs(unsupported)
+	return base64.StdEncoding.EncodeToString([]byte(session.String()))
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeWait bounds how long a single write to a client may take
+const writeWait = 10 * time.Second
+
+// queueDepthSmoothing is the weight of the newest sample in a client's
+// moving average queue depth
+const queueDepthSmoothing = 0.2
+
+var (
+	errSendQueueFull     = errors.New("send queue full")
+	errPauseQueueFull    = errors.New("pause queue full")
+	errFrameRateExceeded = errors.New("frame rate exceeded")
+	errClientClosed      = errors.New("client closed")
+)
+
+// Client is a connected client, over whichever transport its sender uses.
+// Messages to the client are queued and written by its own writePump
+// goroutine, so that a client that is slow to drain its socket only ever
+// delays itself and never the connection that is forwarding to it.
+// Transports such as gorilla/websocket support only one concurrent writer;
+// writeMutex is held around every write.
+type Client struct {
+	Identity   string
+	writeMutex sync.Mutex
+
+	// id changes when the connection upgrades to an identity while other
+	// connections may be forwarding to it, so it is read with ID
+	id atomic.Pointer[string]
+
+	// sender is only replaced by Handoff, which holds both writeMutex and
+	// senderMutex; holding either is enough to read it
+	sender      Sender
+	senderMutex sync.RWMutex
+
+	// origin is where the connection was opened from, see requestOrigin
+	origin string
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// dedup drops repeated forwards to this client; nil when disabled
+	dedup *dedupWindow
+
+	// batch coalesces candidates forwarded to this client; nil when
+	// disabled
+	batch *candidateBatcher
+
+	// limiter caps the rate of messages from this client; nil when disabled
+	limiter *tokenBucket
+
+	// connectedAt is when the client connected, and lastActive when it
+	// last sent a message, in Unix nanoseconds
+	connectedAt time.Time
+	lastActive  atomic.Int64
+
+	// queueDepthAvg is the moving average of len(send), as float64 bits,
+	// and slow is set while it is above the slow client threshold
+	queueDepthAvg atomic.Uint64
+	slow          atomic.Bool
+
+	// ready is set once the client has acknowledged the welcome
+	ready atomic.Bool
+
+	// deltas is set for clients that joined their room asking for roster
+	// deltas instead of full rosters
+	deltas atomic.Bool
+
+	// generation counts the negotiations this client restarted with
+	// "sdp-reset"; dedup only matches its signals within a generation
+	generation atomic.Uint64
+
+	// resumeToken lets the client resume this connection after it drops,
+	// unless resumable was cleared because it asked to disconnect
+	resumeToken string
+	resumable   atomic.Bool
+
+	// codecs are the codecs the client advertised it can receive, nil if
+	// it has not
+	codecs atomic.Pointer[[]string]
+
+	// profile is what the client set with "set-metadata"
+	profile      ConnectionProfile
+	profileMutex sync.Mutex
+
+	// While paused, forwarded signals are held back in held instead of
+	// being queued for writing
+	pauseMutex sync.Mutex
+	paused     bool
+	held       [][]byte
+}
+
+// NewClient wraps sender and starts writing queued messages to it
+func NewClient(id string, sender Sender, queueSize int) *Client {
+	client := &Client{
+		sender:      sender,
+		send:        make(chan []byte, queueSize),
+		done:        make(chan struct{}),
+		connectedAt: time.Now(),
+	}
+	client.setID(id)
+	client.Touch()
+	go client.writePump()
+	return client
+}
+
+// ID returns the connection ID
+func (c *Client) ID() string {
+	return *c.id.Load()
+}
+
+func (c *Client) setID(id string) {
+	c.id.Store(&id)
+}
+
+// Touch marks the client as active now
+func (c *Client) Touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive returns when the client last sent a message
+func (c *Client) LastActive() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// WriteJSON queues a message for the client
+func (c *Client) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(data)
+}
+
+// WriteMessage queues an already encoded text message for the client. It
+// fails rather than blocks when the client's queue is full.
+func (c *Client) WriteMessage(data []byte) error {
+	if c.Closed() {
+		return errClientClosed
+	}
+
+	select {
+	case c.send <- data:
+		return nil
+	default:
+		return errSendQueueFull
+	}
+}
+
+// Forward queues a signal forwarded from another client. While the client is
+// paused the signal is held back instead, up to limit signals.
+func (c *Client) Forward(data []byte, limit int) error {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+
+	if !c.paused {
+		return c.WriteMessage(data)
+	}
+	if len(c.held) >= limit {
+		return errPauseQueueFull
+	}
+	c.held = append(c.held, data)
+	return nil
+}
+
+// Profile returns the client's profile
+func (c *Client) Profile() ConnectionProfile {
+	c.profileMutex.Lock()
+	defer c.profileMutex.Unlock()
+	return c.profile
+}
+
+// SetProfile replaces the client's profile
+func (c *Client) SetProfile(profile ConnectionProfile) {
+	c.profileMutex.Lock()
+	defer c.profileMutex.Unlock()
+	c.profile = profile
+}
+
+// DropHeld discards the signals held back while paused and returns how many
+// there were
+func (c *Client) DropHeld() int {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+
+	dropped := len(c.held)
+	c.held = nil
+	return dropped
+}
+
+// Pause holds back forwarded signals until Resume is called
+func (c *Client) Pause() {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	c.paused = true
+}
+
+// Resume queues the held back signals in the order they arrived and lets
+// further signals through. It returns how many held signals were queued.
+// When the send queue fills up first the client stays paused, holding the
+// signals that did not fit, so that a later Resume can deliver them.
+func (c *Client) Resume() (int, error) {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+
+	for i, data := range c.held {
+		if err := c.WriteMessage(data); err != nil {
+			c.held = c.held[i:]
+			return i, err
+		}
+	}
+	delivered := len(c.held)
+	c.held = nil
+	c.paused = false
+	return delivered, nil
+}
+
+// TrimQueue drops the oldest messages waiting to be written until at most
+// keep are left, and returns how many it dropped
+func (c *Client) TrimQueue(keep int) int {
+	dropped := 0
+	for len(c.send) > keep {
+		select {
+		case <-c.send:
+			dropped++
+		default:
+			return dropped
+		}
+	}
+	return dropped
+}
+
+// QueueDepth returns the number of messages waiting to be written
+func (c *Client) QueueDepth() int {
+	return len(c.send)
+}
+
+// QueueDepthAvg returns the moving average of the client's queue depth
+func (c *Client) QueueDepthAvg() float64 {
+	return math.Float64frombits(c.queueDepthAvg.Load())
+}
+
+// Slow reports whether the client is consistently slow to drain its queue
+func (c *Client) Slow() bool {
+	return c.slow.Load()
+}
+
+// sampleQueueDepth folds the current queue depth into the moving average and
+// updates the slow flag. It reports whether the client just became slow.
+func (c *Client) sampleQueueDepth(threshold float64) bool {
+	avg := queueDepthSmoothing*float64(c.QueueDepth()) + (1-queueDepthSmoothing)*c.QueueDepthAvg()
+	c.queueDepthAvg.Store(math.Float64bits(avg))
+
+	slow := avg >= threshold
+	return c.slow.Swap(slow) != slow && slow
+}
+
+// Close marks the client closed and stops the write pump. Queued messages
+// that were not yet written are discarded, and further writes fail with
+// errClientClosed. The socket itself is left for the caller to close.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Closed reports whether Close has been called
+func (c *Client) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sender returns the transport the client is currently connected by
+func (c *Client) Sender() Sender {
+	c.senderMutex.RLock()
+	defer c.senderMutex.RUnlock()
+	return c.sender
+}
+
+// Handoff moves the client to a new transport, sending it first, then
+// whatever the old transport was still holding for the client, and
+// returns the old transport. It fails if the client is closed.
+func (c *Client) Handoff(sender Sender, first []byte) (Sender, bool) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.Closed() {
+		return nil, false
+	}
+
+	c.senderMutex.Lock()
+	old := c.sender
+	c.sender = sender
+	c.senderMutex.Unlock()
+
+	messages := [][]byte{first}
+	if buffered, ok := old.(bufferedSender); ok {
+		messages = append(messages, buffered.Pending()...)
+	}
+	for _, data := range messages {
+		if err := sender.Send(data); err != nil {
+			break
+		}
+	}
+	return old, true
+}
+
+// sendClose tells the client why its connection is ending, behind any
+// write in progress
+func (c *Client) sendClose(code int, reason string) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.sender.SendClose(code, reason)
+}
+
+// writePump writes queued messages until the client is closed. A failed
+// write closes the connection, which ends the client's read loop.
+func (c *Client) writePump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			c.writeMutex.Lock()
+			// The client may have been closed while waiting for the lock
+			if c.Closed() {
+				c.writeMutex.Unlock()
+				return
+			}
+			sender := c.sender
+			err := sender.Send(data)
+			c.writeMutex.Unlock()
+			if err != nil {
+				sender.Close()
+				return
+			}
+		}
+	}
+}
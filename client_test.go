@@ -0,0 +1,223 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledSender is a Sender whose writes block until it is released, like a
+// client that stopped reading its socket
+type stalledSender struct {
+	release chan struct{}
+	once    sync.Once
+}
+
+func newStalledSender() *stalledSender {
+	return &stalledSender{release: make(chan struct{})}
+}
+
+func (s *stalledSender) Send(data []byte) error {
+	<-s.release
+	return nil
+}
+
+func (s *stalledSender) SendClose(code int, reason string) {}
+
+func (s *stalledSender) Close() error {
+	s.once.Do(func() { close(s.release) })
+	return nil
+}
+
+func TestSlowClientFlagged(t *testing.T) {
+	sender := newStalledSender()
+	client := NewClient("slow", sender, 64)
+	defer client.Close()
+	for i := 0; i < 32; i++ {
+		if err := client.WriteMessage([]byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	became := false
+	for i := 0; i < 20 && !client.Slow(); i++ {
+		became = client.sampleQueueDepth(8)
+	}
+	if !client.Slow() || !became {
+		t.Fatalf("client with %d queued messages not flagged, avg depth %.1f", client.QueueDepth(), client.QueueDepthAvg())
+	}
+
+	sender.Close()
+	for i := 0; i < 50 && client.Slow(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		client.sampleQueueDepth(8)
+	}
+	if client.Slow() {
+		t.Fatalf("client still flagged after draining its queue")
+	}
+}
+
+func TestAdminListsSlowClients(t *testing.T) {
+	ws := NewWebSocketServer(Options{AdminToken: "tok", SlowClientThreshold: 4, QueueSampleInterval: 10 * time.Millisecond})
+	srv := startServer(t, ws)
+	fast := dial(t, srv, "/ws")
+
+	sender := newStalledSender()
+	slow := NewClient("slow", sender, 64)
+	defer sender.Close()
+	ws.connectionManager.Add(slow.ID(), slow)
+	for i := 0; i < 16; i++ {
+		slow.WriteMessage([]byte("{}"))
+	}
+
+	var slowClients []SlowClient
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, srv, "/admin/slow-clients", "tok", &slowClients)
+		if len(slowClients) > 0 {
+			break
+		}
+	}
+	if len(slowClients) != 1 || slowClients[0].ID != "slow" || slowClients[0].QueueDepth == 0 {
+		t.Fatalf("slow clients %+v, want only the stalled one and not %s", slowClients, fast.id)
+	}
+	if resp := getJSON(t, srv, "/admin/slow-clients", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status %d without a token", resp.StatusCode)
+	}
+}
+
+// logBuffer collects log output from concurrent goroutines
+type logBuffer struct {
+	buffer strings.Builder
+	mutex  sync.Mutex
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// captureLog redirects the log for the rest of the test
+func captureLog(t *testing.T) *logBuffer {
+	buffer := &logBuffer{}
+	log.SetOutput(buffer)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buffer
+}
+
+func TestForwardingDuringShutdown(t *testing.T) {
+	logs := captureLog(t)
+	ws := NewWebSocketServer(Options{SendQueueSize: 4096})
+	srv := startServer(t, ws)
+	var clients []*testClient
+	for i := 0; i < 10; i++ {
+		clients = append(clients, dial(t, srv, "/ws"))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		target := clients[(i+1)%len(clients)].id
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				message := map[string]string{"signalType": "candidate", "userId": target, "candidate": "c"}
+				if client.conn.WriteJSON(message) != nil {
+					return
+				}
+			}
+		}(client)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ws.CloseAll()
+	for _, client := range clients {
+		client.expectClose()
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, failure := range []string{"Failed to forward", "closed network connection"} {
+		if strings.Contains(logs.String(), failure) {
+			t.Fatalf("forwards failed during shutdown:\n%s", logs)
+		}
+	}
+}
+
+func TestPauseHoldsSignalsUntilResume(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{PauseQueueSize: 2}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	b.send(map[string]string{"signalType": "pause"})
+	b.readType("paused")
+
+	for _, candidate := range []string{"1", "2", "3"} {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+	}
+	b.expectNone(100 * time.Millisecond)
+
+	// Only the first two fit in the pause queue
+	b.send(map[string]string{"signalType": "resume"})
+	for _, candidate := range []string{"1", "2"} {
+		if message := b.read(); message["candidate"] != candidate {
+			t.Fatalf("got %v, want held candidate %s", message, candidate)
+		}
+	}
+	if message := b.readType("resumed"); message["delivered"] != 2.0 {
+		t.Fatalf("resumed %v", message)
+	}
+
+	a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "4"})
+	if message := b.readType("candidate"); message["candidate"] != "4" {
+		t.Fatalf("got %v after resuming", message)
+	}
+}
+
+func TestResumeKeepsSignalsThatDoNotFit(t *testing.T) {
+	sender := newStalledSender()
+	client := NewClient("paused", sender, 2)
+	defer client.Close()
+	for client.WriteMessage([]byte("{}")) == nil {
+	}
+
+	client.Pause()
+	for _, candidate := range []string{"1", "2"} {
+		if err := client.Forward([]byte(candidate), 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered, err := client.Resume(); delivered != 0 || err != errSendQueueFull {
+		t.Fatalf("resumed into a full queue: delivered %d, %v", delivered, err)
+	}
+
+	// Still paused, so a signal forwarded now waits behind the held ones
+	if err := client.Forward([]byte("3"), 8); err != nil {
+		t.Fatal(err)
+	}
+	sender.Close()
+	for deadline := time.Now().Add(readTimeout); client.QueueDepth() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never drained")
+		}
+	}
+	if delivered, err := client.Resume(); delivered != 3 || err != nil {
+		t.Fatalf("resumed with %d delivered, %v", delivered, err)
+	}
+}
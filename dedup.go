@@ -0,0 +1,55 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// dedupWindow remembers the most recent messages sent to a connection so
+// that identical repeats can be dropped. It is an LRU of message digests:
+// a repeat refreshes its entry, and once more than size distinct messages
+// have been seen the oldest falls out of the window and would be delivered
+// again.
+type dedupWindow struct {
+	size    int
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+	mutex   sync.Mutex
+}
+
+// newDedupWindow creates a window holding up to size messages
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// Seen records a message and reports whether it was already in the window.
+// Messages are only repeats of ones from the same negotiation generation.
+func (d *dedupWindow) Seen(generation uint64, message []byte) bool {
+	hash := sha256.New()
+	binary.Write(hash, binary.BigEndian, generation)
+	hash.Write(message)
+	var key [sha256.Size]byte
+	hash.Sum(key[:0])
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if element, ok := d.entries[key]; ok {
+		d.order.MoveToFront(element)
+		return true
+	}
+
+	d.entries[key] = d.order.PushFront(key)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.([sha256.Size]byte))
+	}
+	return false
+}
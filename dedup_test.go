@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupWindowEviction(t *testing.T) {
+	window := newDedupWindow(2)
+	seen := func(message string) bool {
+		return window.Seen(0, []byte(message))
+	}
+
+	if seen("a") || !seen("a") {
+		t.Fatalf("repeat inside the window not caught")
+	}
+	seen("b")
+	seen("c")
+	if seen("a") {
+		t.Fatalf("message pushed out of the window still deduplicated")
+	}
+	if !seen("c") {
+		t.Fatalf("recent message not deduplicated")
+	}
+}
+
+func TestDedupWindowOverConnection(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{Dedup: true, DedupWindow: 2}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	candidate := func(candidate string) {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+	}
+
+	candidate("1")
+	b.readType("candidate")
+	candidate("1")
+	b.expectNone(100 * time.Millisecond)
+
+	candidate("2")
+	b.readType("candidate")
+	candidate("3")
+	b.readType("candidate")
+	candidate("1")
+	if message := b.readType("candidate"); message["candidate"] != "1" {
+		t.Fatalf("got %v, want the candidate that left the window", message)
+	}
+}
+
+func TestDedupPerGeneration(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{Dedup: true, DedupPerGeneration: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	candidate := map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c"}
+
+	a.send(candidate)
+	a.send(candidate)
+	b.readType("candidate")
+	b.expectNone(50 * time.Millisecond)
+
+	// After renegotiating the same candidate is new again, but only once
+	a.send(map[string]string{"signalType": "sdp-reset"})
+	a.send(candidate)
+	a.send(candidate)
+	if message := b.readType("candidate"); message["candidate"] != "c" {
+		t.Fatalf("got %v after sdp-reset", message)
+	}
+	b.expectNone(50 * time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Eviction policies, for new connections arriving at MaxConnections
+const (
+	// EvictionReject refuses the new connection
+	EvictionReject = "reject"
+	// EvictionLRU closes the least recently active connection to admit it
+	EvictionLRU = "evict-lru"
+)
+
+// parseEvictionPolicy checks an -eviction-policy value
+func parseEvictionPolicy(policy *string) func(string) error {
+	return func(value string) error {
+		if value != EvictionReject && value != EvictionLRU {
+			return fmt.Errorf("must be %s or %s", EvictionReject, EvictionLRU)
+		}
+		*policy = value
+		return nil
+	}
+}
+
+// evictForCapacity makes room for a new connection under the evict-lru
+// policy by closing the connection that has gone longest without sending
+// anything, and reports whether it did
+func (ws *WebSocketServer) evictForCapacity() bool {
+	if ws.opts.EvictionPolicy != EvictionLRU {
+		return false
+	}
+
+	var victim *Client
+	for _, client := range ws.connectionManager.All() {
+		// Clients evicted a moment ago are still on their way out
+		if client.Closed() {
+			continue
+		}
+		if victim == nil || client.LastActive().Before(victim.LastActive()) {
+			victim = client
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	log.Printf("[%s] Evicted after %s idle to admit a new connection 👋\n", victim.ID(), time.Since(victim.LastActive()).Round(time.Second))
+	ws.metrics.connectionsEvicted.Add(1)
+	victim.resumable.Store(false)
+	ws.leaveRoom(victim)
+	ws.matchmaker.Cancel(victim.ID())
+	victim.Close()
+	victim.sendClose(websocket.CloseTryAgainLater, "evicted to make room for a new connection")
+	victim.Sender().Close()
+	return true
+}
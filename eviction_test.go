@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEvictLeastRecentlyActive(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxConnections: 2, EvictionPolicy: EvictionLRU}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.touch()
+
+	c := dial(t, srv, "/ws")
+	err := b.expectClose()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseTryAgainLater || !strings.Contains(closeErr.Text, "evicted") {
+		t.Fatalf("idle connection ended with %v, want it evicted", err)
+	}
+
+	// The connections that were active stay
+	a.send(map[string]string{"signalType": "candidate", "userId": c.id, "candidate": "c"})
+	c.readType("candidate")
+}
+
+func TestRejectAtConnectionLimit(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxConnections: 1}))
+	a := dial(t, srv, "/ws")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection past the limit: %v", resp)
+	}
+	var body HTTPError
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error != "too_many_connections" {
+		t.Fatalf("refused with %+v: %v", body, err)
+	}
+
+	// The connection already in is left alone
+	a.touch()
+}
+
+func TestEvictedClientsDoNotCountAgainstTheLimit(t *testing.T) {
+	// Long-polling sessions only go away once their expiry notices, long
+	// after being evicted
+	ws := NewWebSocketServer(Options{MaxConnections: 2, EvictionPolicy: EvictionLRU, LongPoll: true, LongPollTimeout: time.Minute})
+	srv := startServer(t, ws)
+	a := openSession(t, srv, "/poll")
+	a.pollType("welcome")
+	b := dial(t, srv, "/ws")
+	b.touch()
+
+	c := dial(t, srv, "/ws")
+	if status, _ := a.poll(); status != http.StatusGone {
+		t.Fatalf("evicted session polled with status %d", status)
+	}
+	if _, exists := ws.connectionManager.Get(a.id); !exists {
+		t.Fatalf("evicted session already unregistered")
+	}
+	b.send(map[string]string{"signalType": "disconnect"})
+	b.expectClose()
+	waitUnregistered(t, ws, b.id)
+
+	// There is room for d without evicting c
+	d := dial(t, srv, "/ws")
+	c.expectNone(100 * time.Millisecond)
+	d.send(map[string]string{"signalType": "candidate", "userId": c.id, "candidate": "c"})
+	c.readType("candidate")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// upgrade upgrades a request to a WebSocket. With MaxFrameRate set, every
+// frame the client sends counts against a rate limit of its own.
+func (ws *WebSocketServer) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if ws.opts.MaxFrameRate > 0 {
+		w = frameLimitedResponse{w, newTokenBucket(float64(ws.opts.MaxFrameRate), ws.opts.MaxFrameRate)}
+	}
+	return ws.upgrader.Upgrade(w, r, nil)
+}
+
+// frameLimitedResponse hands the WebSocket upgrade a frameLimitedConn in
+// place of the connection it hijacks
+type frameLimitedResponse struct {
+	http.ResponseWriter
+	frames *tokenBucket
+}
+
+func (w frameLimitedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The upgrade refuses clients that sent data before the handshake
+	// completed, which it tells from what is buffered here
+	if rw.Reader.Buffered() > 0 {
+		return conn, rw, nil
+	}
+	limited := &frameLimitedConn{Conn: conn, frames: w.frames}
+	return limited, bufio.NewReadWriter(bufio.NewReader(limited), bufio.NewWriter(limited)), nil
+}
+
+// frameLimitedConn counts the frames a WebSocket client sends, data,
+// continuation and control frames alike, by following the frame headers in
+// what is read from the connection. Reading fails with errFrameRateExceeded
+// once the client goes over its frame rate, so a message split into many
+// tiny fragments costs as much as that many messages.
+type frameLimitedConn struct {
+	net.Conn
+	frames *tokenBucket
+
+	// header collects the header of the next frame, and remaining is the
+	// payload of the current frame still to be read
+	header    []byte
+	remaining uint64
+}
+
+func (c *frameLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if countErr := c.count(p[:n]); countErr != nil {
+		return 0, countErr
+	}
+	return n, err
+}
+
+// count follows the frames in data, taking a token for every frame header
+func (c *frameLimitedConn) count(data []byte) error {
+	for len(data) > 0 {
+		if c.remaining > 0 {
+			skip := uint64(len(data))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			c.remaining -= skip
+			data = data[skip:]
+			continue
+		}
+
+		c.header = append(c.header, data[0])
+		data = data[1:]
+		size := frameHeaderSize(c.header)
+		if size == 0 || len(c.header) < size {
+			continue
+		}
+		c.remaining = framePayloadLength(c.header)
+		c.header = c.header[:0]
+		if !c.frames.Allow() {
+			return errFrameRateExceeded
+		}
+	}
+	return nil
+}
+
+// frameHeaderSize returns the size of a frame header from its first two
+// bytes, or 0 if fewer have been read
+func frameHeaderSize(header []byte) int {
+	if len(header) < 2 {
+		return 0
+	}
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	// Masking key
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+// framePayloadLength reads the payload length from a complete frame header
+func framePayloadLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
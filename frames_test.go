@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaxFrameRateClosesFloodingClient(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxFrameRate: 20}))
+	a := dial(t, srv, "/ws")
+	for i := 0; i < 100; i++ {
+		if a.conn.WriteMessage(websocket.TextMessage, []byte("{}")) != nil {
+			break
+		}
+	}
+	a.expectCloseCode(websocket.ClosePolicyViolation)
+}
+
+func TestMaxFrameRateCountsControlFrames(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxFrameRate: 20}))
+	a := dial(t, srv, "/ws")
+	for i := 0; i < 100; i++ {
+		if a.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) != nil {
+			break
+		}
+	}
+	a.expectCloseCode(websocket.ClosePolicyViolation)
+}
+
+func TestMaxFrameRateAllowsNormalTraffic(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxFrameRate: 20}))
+	a := dial(t, srv, "/ws")
+	for i := 0; i < 10; i++ {
+		a.touch()
+	}
+}
+
+// clientFrame encodes a masked client frame. The masking key is zero, which
+// leaves the payload as is.
+func clientFrame(opcode byte, final bool, payload string) []byte {
+	frame := []byte{opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	if final {
+		frame[0] |= 0x80
+	}
+	return append(frame, payload...)
+}
+
+func TestMaxFrameRateCountsFragments(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxFrameRate: 20}))
+	a := dial(t, srv, "/ws")
+
+	// A single message split into a flood of one byte fragments
+	message := clientFrame(websocket.TextMessage, false, "{")
+	for i := 0; i < 100; i++ {
+		message = append(message, clientFrame(0, false, " ")...)
+	}
+	message = append(message, clientFrame(0, true, "}")...)
+	if _, err := a.conn.NetConn().Write(message); err != nil {
+		t.Fatal(err)
+	}
+	a.expectCloseCode(websocket.ClosePolicyViolation)
+}
+
+func TestFrameHeaderParsing(t *testing.T) {
+	conn := &frameLimitedConn{frames: newTokenBucket(0.001, 3)}
+	long := append([]byte{0x82, 0x80 | 126, 0x01, 0x00, 0, 0, 0, 0}, make([]byte, 256)...)
+	frames := append(long, clientFrame(websocket.TextMessage, true, "{}")...)
+
+	// Headers split across reads are still found
+	for _, b := range frames {
+		if err := conn.count([]byte{b}); err != nil {
+			t.Fatalf("two frames went over a burst of three: %v", err)
+		}
+	}
+	if err := conn.count(clientFrame(websocket.PingMessage, true, "")); err != nil {
+		t.Fatalf("third frame refused: %v", err)
+	}
+	if err := conn.count(clientFrame(websocket.PingMessage, true, "")); err != errFrameRateExceeded {
+		t.Fatalf("fourth frame got %v, want errFrameRateExceeded", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// handoffFor finds the open connection a request asks to take over with
+// its resume token, so that a client falling back from WebSocket to
+// long-polling or SSE, or upgrading the other way, keeps its connection
+func (ws *WebSocketServer) handoffFor(r *http.Request) (*Client, bool) {
+	token := r.URL.Query().Get("resume")
+	if ws.opts.ResumeGrace <= 0 || token == "" {
+		return nil, false
+	}
+	for _, client := range ws.connectionManager.All() {
+		if client.resumeToken != "" && !client.Closed() && subtle.ConstantTimeCompare([]byte(client.resumeToken), []byte(token)) == 1 {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// handoff moves a client to a new transport. It keeps its ID, room and
+// everything queued for it, and gets a fresh welcome on the new transport,
+// marked resumed; the old transport is closed.
+func (ws *WebSocketServer) handoff(client *Client, sender Sender) bool {
+	welcome := ws.welcomeFor(client)
+	welcome.Resumed = true
+	if ws.opts.ResumeMetadata {
+		profile := client.Profile()
+		welcome.Profile = &profile
+	}
+	data, err := json.Marshal(welcome)
+	if err != nil {
+		log.Printf("❌ Failed to encode welcome: %v\n", err)
+		return false
+	}
+
+	old, ok := client.Handoff(sender, data)
+	if !ok {
+		return false
+	}
+	log.Printf("[%s] Moved to another transport 🔁\n", client.ID())
+
+	ws.pollSessions.removeClient(client)
+	old.SendClose(websocket.CloseNormalClosure, "moved to another transport")
+	old.Close()
+	return true
+}
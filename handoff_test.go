@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandoffFromLongPollToWebSocket(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{LongPoll: true, LongPollTimeout: 200 * time.Millisecond, ResumeGrace: time.Minute}))
+	p := openSession(t, srv, "/poll")
+	token, _ := p.pollType("welcome")["resumeToken"].(string)
+	if token == "" {
+		t.Fatalf("no resume token in the welcome")
+	}
+	p.send(map[string]string{"signalType": "join", "room": "r"})
+	p.pollType("joined")
+	b := dial(t, srv, "/ws")
+	b.join("r")
+
+	// Signals the session has not polled for yet move with it
+	for _, candidate := range []string{"1", "2"} {
+		b.send(map[string]string{"signalType": "candidate", "userId": p.id, "candidate": candidate})
+	}
+	b.touch()
+	w := dial(t, srv, "/ws?resume="+token)
+	if w.id != p.id || w.welcome["resumed"] != true {
+		t.Fatalf("welcome %v, want %s resumed", w.welcome, p.id)
+	}
+	for _, candidate := range []string{"1", "2"} {
+		if message := w.readType("candidate"); message["candidate"] != candidate {
+			t.Fatalf("got %v, want queued candidate %s", message, candidate)
+		}
+	}
+	if status, _ := p.poll(); status != http.StatusNotFound && status != http.StatusGone {
+		t.Fatalf("old session polled with status %d", status)
+	}
+
+	// The connection is still in its room
+	w.send(map[string]string{"signalType": "leave"})
+	if message := b.readType("peer_left"); message["userId"] != p.id {
+		t.Fatalf("got %v", message)
+	}
+}
+
+func TestHandoffFromWebSocketToLongPoll(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{LongPoll: true, LongPollTimeout: 200 * time.Millisecond, ResumeGrace: time.Minute}))
+	w := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	token := w.welcome["resumeToken"].(string)
+
+	p := openSession(t, srv, "/poll?resume="+token)
+	if p.id != w.id {
+		t.Fatalf("session has ID %s, want %s", p.id, w.id)
+	}
+	w.expectCloseCode(websocket.CloseNormalClosure)
+	if welcome := p.pollType("welcome"); welcome["resumed"] != true {
+		t.Fatalf("welcome %v", welcome)
+	}
+
+	b.send(map[string]string{"signalType": "candidate", "userId": w.id, "candidate": "c"})
+	if message := p.pollType("candidate"); message["userId"] != b.id {
+		t.Fatalf("got %v", message)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readTimeout is how long a test waits for a message it expects
+const readTimeout = 2 * time.Second
+
+// testClient is a WebSocket connection to a test server. Frames are read in
+// the background so that tests can wait for them with a timeout.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	id       string
+	welcome  map[string]interface{}
+	messages chan []byte
+	closed   chan error
+}
+
+// startServer serves ws over HTTP until the test ends
+func startServer(t *testing.T, ws *WebSocketServer) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(ws.routes())
+	t.Cleanup(func() {
+		srv.Close()
+		ws.CloseAll()
+		ws.Stop()
+	})
+	return srv
+}
+
+// wsURL turns the URL of a test server into a WebSocket URL for path
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
+
+// dial connects to the server and reads the welcome
+func dial(t *testing.T, srv *httptest.Server, path string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, path), nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := newTestClient(t, conn)
+	client.welcome = client.readType("welcome")
+	client.id, _ = client.welcome["userId"].(string)
+	return client
+}
+
+// newTestClient starts reading frames from an open connection
+func newTestClient(t *testing.T, conn *websocket.Conn) *testClient {
+	client := &testClient{
+		t:        t,
+		conn:     conn,
+		messages: make(chan []byte, 1024),
+		closed:   make(chan error, 1),
+	}
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				client.closed <- err
+				return
+			}
+			client.messages <- data
+		}
+	}()
+	return client
+}
+
+func (c *testClient) send(message interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(message); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// read waits for the next message
+func (c *testClient) read() map[string]interface{} {
+	c.t.Helper()
+	select {
+	case data := <-c.messages:
+		var message map[string]interface{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			c.t.Fatalf("read: %v: %s", err, data)
+		}
+		return message
+	case err := <-c.closed:
+		c.t.Fatalf("read: connection closed: %v", err)
+	case <-time.After(readTimeout):
+		c.t.Fatalf("read: timed out")
+	}
+	return nil
+}
+
+// readType skips messages until one of the given signal type arrives
+func (c *testClient) readType(signalType string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		if message := c.read(); message["signalType"] == signalType {
+			return message
+		}
+	}
+}
+
+// readError waits for an error and checks its code
+func (c *testClient) readError(code string) map[string]interface{} {
+	c.t.Helper()
+	message := c.readType("error")
+	if message["error"] != code {
+		c.t.Fatalf("got error %v, want %s", message["error"], code)
+	}
+	return message
+}
+
+// expectNone checks that no message arrives for a while
+func (c *testClient) expectNone(wait time.Duration) {
+	c.t.Helper()
+	select {
+	case data := <-c.messages:
+		c.t.Fatalf("unexpected message: %s", data)
+	case <-time.After(wait):
+	}
+}
+
+// expectClose waits for the server to close the connection and returns the
+// close error
+func (c *testClient) expectClose() error {
+	c.t.Helper()
+	for {
+		select {
+		case <-c.messages:
+		case err := <-c.closed:
+			return err
+		case <-time.After(readTimeout):
+			c.t.Fatalf("connection not closed")
+			return nil
+		}
+	}
+}
+
+// expectCloseCode waits for the server to close the connection with code
+func (c *testClient) expectCloseCode(code int) {
+	c.t.Helper()
+	err := c.expectClose()
+	if !websocket.IsCloseError(err, code) {
+		c.t.Fatalf("connection ended with %v, want close code %d", err, code)
+	}
+}
+
+// waitUnregistered waits for the server to forget a connection
+func waitUnregistered(t *testing.T, ws *WebSocketServer, id string) {
+	t.Helper()
+	for deadline := time.Now().Add(readTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if _, exists := ws.connectionManager.Get(id); !exists {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection %s still registered", id)
+		}
+	}
+}
+
+// join puts the client in a room and waits until it is in
+func (c *testClient) join(room string) map[string]interface{} {
+	c.t.Helper()
+	c.send(map[string]string{"signalType": "join", "room": room})
+	return c.readType("joined")
+}
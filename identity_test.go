@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// upgradeIdentity claims identity for the client and returns its new ID
+func (c *testClient) upgradeIdentity(secret string, identity string) string {
+	c.t.Helper()
+	c.send(map[string]string{"signalType": "upgrade-identity", "token": signIdentity(secret, identity)})
+	c.id = c.readType("identity_upgraded")["userId"].(string)
+	return c.id
+}
+
+func TestVerifyIdentityToken(t *testing.T) {
+	token := signIdentity("secret", "alice")
+	if identity, ok := verifyIdentityToken("secret", token); !ok || identity != "alice" {
+		t.Fatalf("valid token rejected")
+	}
+	for _, token := range []string{"alice", "alice.bad", signIdentity("other", "alice"), "." + token} {
+		if _, ok := verifyIdentityToken("secret", token); ok {
+			t.Fatalf("token %q accepted", token)
+		}
+	}
+}
+
+func TestUpgradeIdentity(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{IdentitySecret: "k"}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+
+	a.send(map[string]string{"signalType": "upgrade-identity", "token": "alice.bad"})
+	a.readError("invalid_token")
+
+	anonymous := a.id
+	if id := a.upgradeIdentity("k", "alice"); id != "alice" {
+		t.Fatalf("new ID %s, want alice", id)
+	}
+	message := b.readType("peer_id_changed")
+	if message["userId"] != "alice" || message["previousId"] != anonymous {
+		t.Fatalf("peers told %v", message)
+	}
+
+	// The connection keeps its place in the room under its new ID
+	b.send(map[string]interface{}{"signalType": "offer", "peerIndex": 0, "sdp_base64": "eA=="})
+	a.readType("offer")
+	b.send(map[string]interface{}{"signalType": "offer", "userId": "alice", "sdp_base64": "eA=="})
+	a.readType("offer")
+	b.send(map[string]interface{}{"signalType": "offer", "userId": anonymous, "sdp_base64": "eA=="})
+	b.readError("target_not_found")
+}
+
+func TestUpgradeIdentityWhileForwarding(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{IdentitySecret: "k"}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if a.conn.WriteJSON(map[string]interface{}{"signalType": "candidate", "peerIndex": 1, "candidate": "c"}) != nil {
+				return
+			}
+		}
+	}()
+	b.upgradeIdentity("k", "bob")
+	<-done
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": "bob", "sdp_base64": "eA=="})
+	if message := b.readType("offer"); message["userId"] != a.id {
+		t.Fatalf("offer from %v, want %s", message["userId"], a.id)
+	}
+}
+
+// touch sends the server a message and waits for it to be handled
+func (c *testClient) touch() {
+	c.t.Helper()
+	c.send(map[string]string{"signalType": "listRooms"})
+	c.readType("rooms")
+}
+
+func TestIdentityDeliversToMostRecentlyActive(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{IdentitySecret: "k"}))
+	laptop := dial(t, srv, "/ws")
+	phone := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	laptop.upgradeIdentity("k", "alice")
+	phone.upgradeIdentity("k", "alice")
+	if laptop.id == phone.id {
+		t.Fatalf("both connections of alice got ID %s", laptop.id)
+	}
+
+	for _, active := range []*testClient{laptop, phone, laptop} {
+		active.touch()
+		b.send(map[string]interface{}{"signalType": "offer", "identity": "alice", "sdp_base64": "eA=="})
+		if message := active.readType("offer"); message["userId"] != b.id {
+			t.Fatalf("offer from %v, want %s", message["userId"], b.id)
+		}
+	}
+	laptop.expectNone(50 * time.Millisecond)
+	phone.expectNone(50 * time.Millisecond)
+
+	b.send(map[string]interface{}{"signalType": "offer", "identity": "bob", "sdp_base64": "eA=="})
+	b.readError("identity_not_found")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// lowPrioritySignals are the signal types shed while the server is
+// overloaded. Negotiation signals (SDP and candidates) are never shed.
+var lowPrioritySignals = map[string]bool{
+	"presence": true,
+	"typing":   true,
+}
+
+// loadMonitor periodically measures the server's load as the mean send
+// queue depth across connections. Queues back up whenever the server falls
+// behind, whether it is short of CPU or of bandwidth.
+func (ws *WebSocketServer) loadMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	overloaded := false
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			clients := ws.connectionManager.All()
+			load := 0.0
+			if len(clients) > 0 {
+				for _, client := range clients {
+					load += float64(client.QueueDepth())
+				}
+				load /= float64(len(clients))
+			}
+			ws.load.Store(math.Float64bits(load))
+
+			if ws.overloaded() != overloaded {
+				overloaded = !overloaded
+				if overloaded {
+					log.Printf("Shedding low priority signals 🔥 (load %.1f)\n", load)
+				} else {
+					log.Printf("Stopped shedding low priority signals (load %.1f)\n", load)
+				}
+			}
+		}
+	}
+}
+
+// Load returns the last measured load
+func (ws *WebSocketServer) Load() float64 {
+	return math.Float64frombits(ws.load.Load())
+}
+
+// overloaded reports whether low priority signals are being shed
+func (ws *WebSocketServer) overloaded() bool {
+	return ws.opts.LoadShedThreshold > 0 && ws.Load() >= ws.opts.LoadShedThreshold
+}
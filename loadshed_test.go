@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadSheddingKeepsCriticalSignals(t *testing.T) {
+	ws := NewWebSocketServer(Options{LoadShedThreshold: 4, QueueSampleInterval: 10 * time.Millisecond})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{"signalType": "typing", "userId": b.id})
+	b.readType("typing")
+
+	// A client that stopped reading backs up its send queue, raising the
+	// mean queue depth past the threshold
+	sender := newStalledSender()
+	stalled := NewClient("stalled", sender, 64)
+	defer sender.Close()
+	ws.connectionManager.Add(stalled.ID(), stalled)
+	for i := 0; i < 32; i++ {
+		stalled.WriteMessage([]byte("{}"))
+	}
+	for deadline := time.Now().Add(readTimeout); !ws.overloaded(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("load %.1f never reached the threshold", ws.Load())
+		}
+	}
+
+	for _, signalType := range []string{"presence", "typing"} {
+		a.send(map[string]interface{}{"signalType": signalType, "userId": b.id})
+		a.readError("load_shed")
+	}
+	a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c"})
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA=="})
+	b.readType("candidate")
+	b.readType("offer")
+	b.expectNone(50 * time.Millisecond)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// pollMailboxSize is how many messages wait for a long-polling client's
+// next GET before writes to it start blocking
+const pollMailboxSize = 64
+
+var errSessionClosed = errors.New("session closed")
+
+// pollSender is the transport of a long-polling or SSE session: messages
+// written to it wait in a mailbox that GET requests empty
+type pollSender struct {
+	mailbox   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// reason is what SendClose was told, for GETs made after the end
+	reason atomic.Value
+}
+
+func newPollSender() *pollSender {
+	return &pollSender{
+		mailbox: make(chan []byte, pollMailboxSize),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *pollSender) Send(data []byte) error {
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+
+	select {
+	case s.mailbox <- data:
+		return nil
+	case <-s.closed:
+		return errSessionClosed
+	case <-timer.C:
+		return errSendQueueFull
+	}
+}
+
+func (s *pollSender) SendClose(code int, reason string) {
+	s.reason.Store(reason)
+}
+
+func (s *pollSender) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// poll waits up to timeout for messages and returns all that are waiting.
+// Messages written before the session closed are still returned; after that
+// poll fails with errSessionClosed.
+func (s *pollSender) poll(ctx context.Context, timeout time.Duration) ([]json.RawMessage, error) {
+	if messages := s.drain(); len(messages) > 0 {
+		return messages, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data := <-s.mailbox:
+		return append([]json.RawMessage{data}, s.drain()...), nil
+	case <-s.closed:
+		if messages := s.drain(); len(messages) > 0 {
+			return messages, nil
+		}
+		return nil, errSessionClosed
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return []json.RawMessage{}, nil
+}
+
+// Pending takes every message waiting in the mailbox
+func (s *pollSender) Pending() [][]byte {
+	messages := s.drain()
+	pending := make([][]byte, len(messages))
+	for i, data := range messages {
+		pending[i] = data
+	}
+	return pending
+}
+
+// trim drops the oldest messages in the mailbox until at most keep are left,
+// and returns how many it dropped
+func (s *pollSender) trim(keep int) int {
+	dropped := 0
+	for len(s.mailbox) > keep {
+		select {
+		case <-s.mailbox:
+			dropped++
+		default:
+			return dropped
+		}
+	}
+	return dropped
+}
+
+// drain takes every message waiting in the mailbox
+func (s *pollSender) drain() []json.RawMessage {
+	var messages []json.RawMessage
+	for {
+		select {
+		case data := <-s.mailbox:
+			messages = append(messages, data)
+		default:
+			return messages
+		}
+	}
+}
+
+// pollSession is a client connected by long-polling or SSE. Its ID is a
+// secret known only to the client, unlike its connection ID, which peers
+// see.
+type pollSession struct {
+	client   *Client
+	sender   *pollSender
+	connCtx  context.Context
+	lastPoll atomic.Int64
+	endOnce  sync.Once
+
+	// receiveMutex makes POSTs take turns, as reads on a WebSocket do
+	receiveMutex sync.Mutex
+
+	// The session's SSE stream, if it has one
+	stream sseStream
+}
+
+// pollSessions holds the open long-polling sessions by session ID
+type pollSessions struct {
+	sessions map[string]*pollSession
+	mutex    sync.RWMutex
+}
+
+func (ps *pollSessions) get(id string) (*pollSession, bool) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	session, ok := ps.sessions[id]
+	return session, ok
+}
+
+// all returns every open session
+func (ps *pollSessions) all() []*pollSession {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	sessions := make([]*pollSession, 0, len(ps.sessions))
+	for _, session := range ps.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (ps *pollSessions) add(id string, session *pollSession) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.sessions == nil {
+		ps.sessions = make(map[string]*pollSession)
+	}
+	ps.sessions[id] = session
+}
+
+// removeClient removes the session of a client, if it has one
+func (ps *pollSessions) removeClient(client *Client) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for id, session := range ps.sessions {
+		if session.client == client {
+			delete(ps.sessions, id)
+		}
+	}
+}
+
+func (ps *pollSessions) remove(id string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.sessions, id)
+}
+
+// handlePoll is the long-polling transport, for clients whose network
+// blocks WebSockets. POST without a session opens one and returns its
+// session ID; with ?session= set, GET waits for messages, POST sends one and
+// DELETE disconnects.
+func (ws *WebSocketServer) handlePoll(w http.ResponseWriter, r *http.Request) {
+	ws.handleSession(w, r, ws.pollMessages)
+}
+
+// handleSession serves the session endpoints shared by long-polling and
+// SSE, which only differ in how GET returns messages
+func (ws *WebSocketServer) handleSession(w http.ResponseWriter, r *http.Request, get func(http.ResponseWriter, *http.Request, *pollSession)) {
+	if len(ws.opts.AllowedOrigins) > 0 && !ws.checkOrigin(r) {
+		httpError(w, http.StatusForbidden, "forbidden", "origin not allowed")
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		ws.openPollSession(w, r)
+		return
+	}
+
+	session, ok := ws.pollSessions.get(sessionID)
+	if !ok {
+		httpError(w, http.StatusNotFound, "session_not_found", "no such session")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		get(w, r, session)
+
+	case http.MethodPost:
+		message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ws.opts.MaxMessageBytes))
+		if err != nil {
+			httpError(w, http.StatusRequestEntityTooLarge, "message_too_large", "message exceeds the size limit")
+			return
+		}
+		session.receiveMutex.Lock()
+		ws.receive(session.connCtx, session.client, message)
+		session.receiveMutex.Unlock()
+		if session.client.Closed() {
+			ws.endPollSession(sessionID, session)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		ws.disconnect(session.client)
+		ws.endPollSession(sessionID, session)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, "GET, POST, DELETE")
+	}
+}
+
+// pollMessages answers a long-polling GET with the messages waiting for the
+// session, once there are any or the poll times out
+func (ws *WebSocketServer) pollMessages(w http.ResponseWriter, r *http.Request, session *pollSession) {
+	session.lastPoll.Store(time.Now().UnixNano())
+	messages, err := session.sender.poll(r.Context(), ws.opts.LongPollTimeout)
+	session.lastPoll.Store(time.Now().UnixNano())
+	if err != nil {
+		reason, _ := session.sender.reason.Load().(string)
+		httpError(w, http.StatusGone, "session_closed", reason)
+		return
+	}
+	writeJSON(w, messages)
+}
+
+// openPollSession connects a new long-polling or SSE client. Its welcome is
+// the first message its first GET returns.
+func (ws *WebSocketServer) openPollSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := uuid.New().String()
+	sender := newPollSender()
+	// The connection outlives the request that opened it
+	connCtx := requestTraceContext(r.WithContext(context.Background()))
+	session := &pollSession{sender: sender, connCtx: connCtx}
+	session.lastPoll.Store(time.Now().UnixNano())
+
+	if client, ok := ws.handoffFor(r); ok {
+		if !ws.handoff(client, sender) {
+			httpError(w, http.StatusGone, "session_closed", "the connection to take over has closed")
+			return
+		}
+		session.client = client
+		ws.pollSessions.add(sessionID, session)
+		go ws.expirePollSession(sessionID, session)
+		writeJSON(w, map[string]string{"sessionId": sessionID, "userId": client.ID()})
+		return
+	}
+
+	id, resumed, ok := ws.acceptConnection(w, r)
+	if !ok {
+		return
+	}
+	session.client = ws.openClient(connCtx, id, requestOrigin(r), sender, resumed)
+	if session.client.Closed() {
+		ws.closeConnection(connCtx, session.client)
+		httpError(w, http.StatusInternalServerError, "connect_failed", "could not open the session")
+		return
+	}
+	ws.pollSessions.add(sessionID, session)
+	go ws.expirePollSession(sessionID, session)
+
+	writeJSON(w, map[string]string{"sessionId": sessionID, "userId": id})
+}
+
+// expirePollSession ends a session once its client is closed or has gone
+// long enough without polling that it has most likely gone away
+func (ws *WebSocketServer) expirePollSession(sessionID string, session *pollSession) {
+	idle := 2 * ws.opts.LongPollTimeout
+	ticker := time.NewTicker(ws.opts.LongPollTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lastPoll := time.Unix(0, session.lastPoll.Load())
+		if session.client.Closed() || time.Since(lastPoll) > idle {
+			ws.endPollSession(sessionID, session)
+			return
+		}
+	}
+}
+
+// endPollSession cleans up after a long-polling client, unless it has moved
+// to another transport
+func (ws *WebSocketServer) endPollSession(sessionID string, session *pollSession) {
+	session.endOnce.Do(func() {
+		ws.pollSessions.remove(sessionID)
+		if session.client.Sender() != session.sender {
+			return
+		}
+		ws.closeConnection(session.connCtx, session.client)
+	})
+}
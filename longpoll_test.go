@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollClient is a client of the long-polling or SSE transport
+type pollClient struct {
+	t   *testing.T
+	url string
+	id  string
+}
+
+// openSession opens a session on the transport served at path, which may
+// carry a query for opening it
+func openSession(t *testing.T, srv *httptest.Server, path string) *pollClient {
+	t.Helper()
+	resp, err := http.Post(srv.URL+path, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var opened map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&opened); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("opening session: %d %v", resp.StatusCode, err)
+	}
+	path, _, _ = strings.Cut(path, "?")
+	return &pollClient{t: t, url: srv.URL + path + "?session=" + opened["sessionId"], id: opened["userId"]}
+}
+
+// send POSTs a message and returns the response status
+func (p *pollClient) send(message interface{}) int {
+	p.t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	resp, err := http.Post(p.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// poll makes a long-polling GET and returns the status and messages
+func (p *pollClient) poll() (int, []map[string]interface{}) {
+	p.t.Helper()
+	resp, err := http.Get(p.url)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var messages []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&messages)
+	return resp.StatusCode, messages
+}
+
+// pollType polls until a message of the given signal type arrives
+func (p *pollClient) pollType(signalType string) map[string]interface{} {
+	p.t.Helper()
+	for deadline := time.Now().Add(readTimeout); time.Now().Before(deadline); {
+		status, messages := p.poll()
+		if status != http.StatusOK {
+			p.t.Fatalf("poll: status %d", status)
+		}
+		for _, message := range messages {
+			if message["signalType"] == signalType {
+				return message
+			}
+		}
+	}
+	p.t.Fatalf("poll: no %s", signalType)
+	return nil
+}
+
+func TestLongPollExchange(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{LongPoll: true, LongPollTimeout: 200 * time.Millisecond}))
+	a := openSession(t, srv, "/poll")
+	b := openSession(t, srv, "/poll")
+	if welcome := a.pollType("welcome"); welcome["userId"] != a.id {
+		t.Fatalf("welcome %v for %s", welcome, a.id)
+	}
+	b.pollType("welcome")
+
+	if status := a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c"}); status != http.StatusNoContent {
+		t.Fatalf("send: status %d", status)
+	}
+	if message := b.pollType("candidate"); message["userId"] != a.id || message["candidate"] != "c" {
+		t.Fatalf("got %v", message)
+	}
+
+	// With nothing waiting a poll times out empty
+	start := time.Now()
+	if status, messages := b.poll(); status != http.StatusOK || len(messages) != 0 || time.Since(start) < 150*time.Millisecond {
+		t.Fatalf("idle poll: %d %v after %v", status, messages, time.Since(start))
+	}
+
+	// Long-polling and WebSocket clients reach each other
+	w := dial(t, srv, "/ws")
+	w.send(map[string]string{"signalType": "candidate", "userId": a.id, "candidate": "from-ws"})
+	if message := a.pollType("candidate"); message["userId"] != w.id {
+		t.Fatalf("got %v", message)
+	}
+	a.send(map[string]string{"signalType": "candidate", "userId": w.id, "candidate": "from-poll"})
+	if message := w.readType("candidate"); message["userId"] != a.id {
+		t.Fatalf("got %v", message)
+	}
+}
+
+func TestLongPollDisconnect(t *testing.T) {
+	ws := NewWebSocketServer(Options{LongPoll: true, LongPollTimeout: 200 * time.Millisecond})
+	srv := startServer(t, ws)
+	a := openSession(t, srv, "/poll")
+	a.pollType("welcome")
+
+	a.send(map[string]string{"signalType": "disconnect"})
+	if status, _ := a.poll(); status != http.StatusNotFound {
+		t.Fatalf("poll after disconnecting: status %d", status)
+	}
+	if _, exists := ws.connectionManager.Get(a.id); exists {
+		t.Fatalf("disconnected session still registered")
+	}
+
+	// A session that stops polling expires
+	b := openSession(t, srv, "/poll")
+	for deadline := time.Now().Add(readTimeout); ; time.Sleep(50 * time.Millisecond) {
+		if _, exists := ws.connectionManager.Get(b.id); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle session never expired")
+		}
+	}
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Note to self:
@@ -23,192 +40,1760 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// ConnectionManager handles WebSocket connections
+// ConnectionManager handles WebSocket connections. Connections that have
+// upgraded to an authenticated identity are also indexed by that identity.
 type ConnectionManager struct {
-	connections map[string]*websocket.Conn
+	connections map[string]*Client
+	identities  map[string][]string
+	aliases     map[string]string
 	mutex       sync.RWMutex
 }
 
 // NewConnectionManager creates a new ConnectionManager
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
-		connections: make(map[string]*websocket.Conn),
+		connections: make(map[string]*Client),
+		identities:  make(map[string][]string),
+		aliases:     make(map[string]string),
 	}
 }
 
-// Add a new connection
-func (cm *ConnectionManager) Add(id string, conn *websocket.Conn) {
+// Add a new connection, indexing it by its identity if it has one
+func (cm *ConnectionManager) Add(id string, client *Client) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	cm.connections[id] = conn
+	cm.connections[id] = client
+	if client.Identity != "" {
+		cm.identities[client.Identity] = append(cm.identities[client.Identity], id)
+	}
 }
 
 // Remove a connection
 func (cm *ConnectionManager) Remove(id string) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
+	if client, exists := cm.connections[id]; exists && client.Identity != "" {
+		cm.unindexLocked(client)
+	}
+	for alias, owner := range cm.aliases {
+		if owner == id {
+			delete(cm.aliases, alias)
+		}
+	}
 	delete(cm.connections, id)
 }
 
+// SetAliases replaces the extra names a connection can be addressed by. It
+// fails, changing nothing, if any of them is taken by another connection.
+func (cm *ConnectionManager) SetAliases(id string, aliases []string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for _, alias := range aliases {
+		if _, taken := cm.connections[alias]; taken && alias != id {
+			return false
+		}
+		if owner, taken := cm.aliases[alias]; taken && owner != id {
+			return false
+		}
+	}
+	for alias, owner := range cm.aliases {
+		if owner == id {
+			delete(cm.aliases, alias)
+		}
+	}
+	for _, alias := range aliases {
+		cm.aliases[alias] = id
+	}
+	return true
+}
+
+// Resolve finds a connection by ID or alias
+func (cm *ConnectionManager) Resolve(name string) (*Client, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	if client, exists := cm.connections[name]; exists {
+		return client, true
+	}
+	client, exists := cm.connections[cm.aliases[name]]
+	return client, exists
+}
+
+// BindIdentity rebinds a connection to an authenticated identity. The first
+// connection of an identity takes the identity itself as its ID; further
+// connections get a suffixed ID so that each stays individually addressable.
+func (cm *ConnectionManager) BindIdentity(oldID string, identity string) (string, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.connections[oldID]
+	if !exists {
+		return "", false
+	}
+	if client.Identity != "" {
+		cm.unindexLocked(client)
+	}
+
+	newID := identity
+	if _, taken := cm.connections[newID]; taken && newID != oldID {
+		newID = identity + "#" + uuid.New().String()[:8]
+	}
+
+	delete(cm.connections, oldID)
+	cm.connections[newID] = client
+	for alias, owner := range cm.aliases {
+		if owner == oldID {
+			cm.aliases[alias] = newID
+		}
+	}
+	client.setID(newID)
+	client.Identity = identity
+	cm.identities[identity] = append(cm.identities[identity], newID)
+	return newID, true
+}
+
+// MostRecent returns the connection of an identity that most recently sent
+// a message
+func (cm *ConnectionManager) MostRecent(identity string) (*Client, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	var latest *Client
+	for _, id := range cm.identities[identity] {
+		client := cm.connections[id]
+		if latest == nil || client.LastActive().After(latest.LastActive()) {
+			latest = client
+		}
+	}
+	return latest, latest != nil
+}
+
+// unindexLocked drops a connection from its identity's connection list.
+// Callers must hold the write lock.
+func (cm *ConnectionManager) unindexLocked(client *Client) {
+	ids := cm.identities[client.Identity]
+	for i, id := range ids {
+		if id == client.ID() {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(cm.identities, client.Identity)
+	} else {
+		cm.identities[client.Identity] = ids
+	}
+}
+
+// All returns every connection
+func (cm *ConnectionManager) All() []*Client {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	clients := make([]*Client, 0, len(cm.connections))
+	for _, client := range cm.connections {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Count returns the number of open connections. Closed clients still on
+// their way out, like evicted long-polling sessions waiting to expire, are
+// not counted.
+func (cm *ConnectionManager) Count() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	count := 0
+	for _, client := range cm.connections {
+		if !client.Closed() {
+			count++
+		}
+	}
+	return count
+}
+
 // Get a connection
-func (cm *ConnectionManager) Get(id string) (*websocket.Conn, bool) {
+func (cm *ConnectionManager) Get(id string) (*Client, bool) {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
-	conn, exists := cm.connections[id]
-	return conn, exists
+	client, exists := cm.connections[id]
+	return client, exists
+}
+
+// SignalEnvelope holds the routing fields shared by all relayed signals.
+// A signal is addressed by userId, by identity (delivered to that
+// identity's most recently active connection) or, for clients in a room,
+// by peerIndex: the target's position in the room roster. A signal for
+// several peers, such as a candidate in a mesh, lists them in userIds
+// instead and is delivered to each as if sent to it alone. A signal for
+// someone with several devices may list fallbacks, tried in order while the
+// target is offline; the sender is told which one it went to. messageId, if
+// any, is forwarded as is.
+type SignalEnvelope struct {
+	SignalType string   `json:"signalType"`
+	UserID     string   `json:"userId"`
+	UserIDs    []string `json:"userIds,omitempty"`
+	Fallbacks  []string `json:"fallbacks,omitempty"`
+	MessageID  string   `json:"messageId,omitempty"`
+	Identity   string   `json:"identity,omitempty"`
+	PeerIndex  *int     `json:"peerIndex,omitempty"`
+	InstanceID string   `json:"instanceId,omitempty"`
+
+	// Hops counts how many times the signal has been relayed. Bridges that
+	// re-inject signals into another server preserve it so that relay
+	// loops are cut off once it exceeds MaxHops.
+	Hops int `json:"hops,omitempty"`
+
+	// Metadata is an optional application defined object (latency hints,
+	// sequence numbers, ...) forwarded unchanged with the signal
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	TraceFields
+}
+
+// DeliveredMessage tells the sender of a signal with fallbacks which target
+// received it, and whether that was a fallback
+type DeliveredMessage struct {
+	SignalType string `json:"signalType"`
+	Signal     string `json:"signal"`
+	To         string `json:"to"`
+	Fallback   bool   `json:"fallback"`
+}
+
+// WelcomeMessage is sent to every client as soon as it connects
+type WelcomeMessage struct {
+	SignalType string         `json:"signalType"`
+	UserID     string         `json:"userId"`
+	InstanceID string         `json:"instanceId,omitempty"`
+	RateLimit  *RateLimitInfo `json:"rateLimit,omitempty"`
+	// RequireReady tells the client to send "ready" before signaling
+	RequireReady bool `json:"requireReady,omitempty"`
+	// Origin is what the client must put in every message when the server
+	// verifies payload origins
+	Origin string `json:"origin,omitempty"`
+	// ResumeToken lets the client get its ID and room back if it
+	// reconnects with ?resume= within the grace window. Resumed is set,
+	// along with the profile that was restored, when it did.
+	ResumeToken string             `json:"resumeToken,omitempty"`
+	Resumed     bool               `json:"resumed,omitempty"`
+	Profile     *ConnectionProfile `json:"profile,omitempty"`
+}
+
+// RateLimitInfo advertises the per-connection message rate limit so that
+// clients can pace themselves instead of running into it
+type RateLimitInfo struct {
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	Burst             int     `json:"burst"`
 }
 
 // SignalMessageSdp represents the structure of WebRTC signaling messages for "answer" and "offer"
 type SignalMessageSdp struct {
-	SignalType string `json:"signalType"`
-	UserID     string `json:"userId"`
-	SDP        string `json:"sdp_base64"`
+	SignalEnvelope
+	SDP string `json:"sdp_base64"`
 }
 
 // SignalMessageSdp represents the structure of WebRTC signaling messages for "candidate" (ice-candidates)
+// and "candidate-complete" (end-of-candidates, sent with an empty candidate)
 type SignalMessageCandidate struct {
+	SignalEnvelope
+	Candidate string `json:"candidate"`
+}
+
+// SignalMessageKeyExchange represents "key-exchange" signals carrying an
+// application's key agreement material (such as DH parameters) between
+// peers. The payload is forwarded byte for byte and never interpreted.
+type SignalMessageKeyExchange struct {
+	SignalEnvelope
+	Payload json.RawMessage `json:"payload"`
+}
+
+// encode marshals the signal with its payload spliced in as it was sent;
+// json.Marshal would compact and HTML-escape it
+func (m *SignalMessageKeyExchange) encode() ([]byte, error) {
+	data, err := json.Marshal(&m.SignalEnvelope)
+	end := bytes.LastIndexByte(data, '}')
+	if err != nil || len(m.Payload) == 0 || end < 0 {
+		return data, err
+	}
+
+	encoded := make([]byte, 0, len(data)+len(m.Payload)+16)
+	encoded = append(encoded, data[:end]...)
+	encoded = append(encoded, `,"payload":`...)
+	encoded = append(encoded, m.Payload...)
+	encoded = append(encoded, data[end:]...)
+	return encoded, nil
+}
+
+// SignalMessageData represents low priority signals such as "presence" and
+// "typing", whose application defined data is forwarded unchanged
+type SignalMessageData struct {
+	SignalEnvelope
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// RoomMessage represents "join" and "leave" requests. Role, Password and
+// Deltas are only read on join; Role defaults to RoleParticipant. Deltas
+// asks for peer_list_changed deltas in place of peer_joined and peer_left.
+type RoomMessage struct {
+	SignalType string `json:"signalType"`
+	Room       string `json:"room"`
+	Role       string `json:"role,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Deltas     bool   `json:"deltas,omitempty"`
+}
+
+// MatchmakeMessage represents a "matchmake" request
+type MatchmakeMessage struct {
+	SignalType string        `json:"signalType"`
+	Criteria   MatchCriteria `json:"criteria"`
+}
+
+// CreateRoomMessage represents a "createRoom" request
+type CreateRoomMessage struct {
+	SignalType string `json:"signalType"`
+	RoomOptions
+}
+
+// BroadcastMessage represents a "broadcast" relayed to every other member of
+// the sender's room. Data is forwarded as is.
+type BroadcastMessage struct {
+	SignalType string          `json:"signalType"`
+	UserID     string          `json:"userId"`
+	InstanceID string          `json:"instanceId,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+}
+
+// RoomEvent notifies clients of room membership changes. Members is the
+// roster in join order, which is the order peerIndex refers to.
+type RoomEvent struct {
+	SignalType string   `json:"signalType"`
+	Room       string   `json:"room"`
+	UserID     string   `json:"userId,omitempty"`
+	PreviousID string   `json:"previousId,omitempty"`
+	Role       string   `json:"role,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Members    []string `json:"members"`
+}
+
+// PeerListDelta is a "peer_list_changed" event: the change to a room's
+// roster, without the roster itself, for members of large rooms
+type PeerListDelta struct {
+	SignalType string   `json:"signalType"`
+	Room       string   `json:"room"`
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+}
+
+// PeersChangedEvent is a "peers_changed" event: the joins and leaves of a
+// batch of membership changes, along with the roster they led to
+type PeersChangedEvent struct {
+	SignalType string   `json:"signalType"`
+	Room       string   `json:"room"`
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+	Members    []string `json:"members"`
+}
+
+// UpgradeIdentityMessage represents an "upgrade-identity" request from an
+// anonymous connection that has since authenticated
+type UpgradeIdentityMessage struct {
+	SignalType string `json:"signalType"`
+	Token      string `json:"token"`
+}
+
+// ErrorMessage reports a rejected signal back to its sender
+type ErrorMessage struct {
 	SignalType string `json:"signalType"`
-	UserID     string `json:"userId"`
-	Candidate  string `json:"candidate"`
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	// Target is the target the error is about, for signals sent to several
+	Target string `json:"target,omitempty"`
+}
+
+// SignalError is a reason for rejecting a signal
+type SignalError struct {
+	Code    string
+	Message string
 }
 
+func (e *SignalError) Error() string {
+	return e.Message
+}
+
+var (
+	errTargetNotFound      = &SignalError{"target_not_found", "target connection not found"}
+	errNotInRoom           = &SignalError{"not_in_room", "peerIndex requires joining a room"}
+	errPeerIndexOutOfRange = &SignalError{"peer_index_out_of_range", "peerIndex is outside the room roster"}
+	errIdentityDisabled    = &SignalError{"identity_disabled", "identity upgrades are not enabled"}
+	errInvalidToken        = &SignalError{"invalid_token", "identity token is invalid"}
+	errIdentityNotFound    = &SignalError{"identity_not_found", "no connection for identity"}
+	errRateLimited         = &SignalError{"rate_limited", "message rate limit exceeded"}
+	errServerRateLimited   = &SignalError{"server_rate_limited", "server wide message rate limit exceeded"}
+	errHopLimitExceeded    = &SignalError{"hop_limit_exceeded", "signal was relayed too many times"}
+	errInvalidSDP          = &SignalError{"invalid_sdp", "sdp_base64 is not valid base64"}
+	errInsecureSDP         = &SignalError{"insecure_sdp", "SDP lacks a DTLS fingerprint or uses an insecure transport"}
+	errInvalidRole         = &SignalError{"invalid_role", "unknown room role"}
+	errSpectator           = &SignalError{"spectator", "spectators cannot send signals"}
+	errWrongPassword       = &SignalError{"wrong_password", "room password is incorrect"}
+	errRoomFull            = &SignalError{"room_full", "room has reached its member limit"}
+	errInvalidRoomOptions  = &SignalError{"invalid_room_options", "room options are invalid"}
+	errInvalidMetadata     = &SignalError{"invalid_metadata", "metadata must be a JSON object"}
+	errMetadataTooLarge    = &SignalError{"metadata_too_large", "metadata exceeds the size limit"}
+	errTooManyTargets      = &SignalError{"too_many_targets", "signal addressed to too many targets"}
+	errFallbacksAndTargets = &SignalError{"fallbacks_with_targets", "fallbacks cannot be combined with userIds"}
+	errKeyExchangeTooLarge = &SignalError{"key_exchange_too_large", "key exchange payload exceeds the size limit"}
+	errReplayDetected      = &SignalError{"replay_detected", "a message with this messageId was already sent"}
+	errInvalidMessageID    = &SignalError{"invalid_message_id", "messageId is too long"}
+	errOriginMismatch      = &SignalError{"origin_mismatch", "message origin does not match the connection's"}
+	errInvalidCallState    = &SignalError{"invalid_call_state", "state must be ringing, accepted, rejected or ended"}
+	errNotReady            = &SignalError{"not_ready", "send ready before signaling"}
+	errRelayDenied         = &SignalError{"relay_denied", "the room's policy does not allow signaling this peer"}
+	errAliasInUse          = &SignalError{"alias_in_use", "alias is taken by another connection"}
+	errLoadShed            = &SignalError{"load_shed", "server is overloaded, low priority signal dropped"}
+	errResumeIncomplete    = &SignalError{"resume_incomplete", "send queue is full, the remaining signals are still held"}
+)
+
 // WebSocketServer manages WebSocket connections and signaling
 type WebSocketServer struct {
+	opts              Options
+	upgrader          websocket.Upgrader
 	connectionManager *ConnectionManager
+	roomManager       *RoomManager
+	matchmaker        *Matchmaker
+	relayPolicies     relayPolicies
+	pollSessions      pollSessions
+	resumes           resumeStore
+	membership        *membershipDebouncer
+	membershipBatch   *membershipBatcher
+	replays           *replayWindow
+	metrics           Metrics
+	tracer            trace.Tracer
+	done              chan struct{}
+	stopOnce          sync.Once
+
+	// limiter caps the message rate of all connections together
+	limiter *tokenBucket
+
+	// load is the last measured load, as float64 bits
+	load atomic.Uint64
+
+	// memoryPressure is the current memory pressure level, as measured
+	// with memoryUsage
+	memoryPressure atomic.Int32
+	memoryUsage    func() uint64
 }
 
-// NewWebSocketServer creates a new WebSocket server
-func NewWebSocketServer() *WebSocketServer {
-	return &WebSocketServer{
+// NewWebSocketServer creates a new WebSocket server and starts its
+// background tasks
+func NewWebSocketServer(opts Options) *WebSocketServer {
+	opts = opts.withDefaults()
+	if opts.AcceptHook == nil && opts.AcceptWebhook != "" {
+		opts.AcceptHook = WebhookAcceptHook(opts.AcceptWebhook, opts.AcceptWebhookTimeout)
+	}
+	ws := &WebSocketServer{
+		opts:              opts,
 		connectionManager: NewConnectionManager(),
+		roomManager:       NewRoomManager(),
+		matchmaker:        NewMatchmaker(opts.MatchSkillRange),
+		tracer:            tracerFor(opts.TracerProvider),
+		done:              make(chan struct{}),
+		memoryUsage:       heapInUse,
+	}
+	ws.metrics.protocolErrors = newProtocolErrors()
+
+	ws.upgrader = upgrader
+	if len(opts.AllowedOrigins) > 0 {
+		ws.upgrader.CheckOrigin = ws.checkOrigin
+	}
+
+	if opts.ServerRateLimit > 0 {
+		ws.limiter = newTokenBucket(opts.ServerRateLimit, opts.ServerRateBurst)
+	}
+
+	ws.roomManager.maxLifetime = opts.RoomMaxLifetime
+	ws.roomManager.soloTimeout = opts.RoomSoloTimeout
+	ws.roomManager.onClose = ws.roomClosed
+	for _, room := range opts.StarRooms {
+		ws.SetRelayPolicy(room, StarPolicy{})
+	}
+
+	if opts.MembershipDebounce > 0 {
+		ws.membership = newMembershipDebouncer(opts.MembershipDebounce, ws.emitMembership)
+	}
+	if opts.ReplayWindow > 0 {
+		ws.replays = newReplayWindow(opts.ReplayWindow)
+	}
+	if opts.MembershipBatch > 0 {
+		ws.membershipBatch = newMembershipBatcher(opts.MembershipBatch, ws.emitMembershipBatch)
+	}
+	if opts.LivenessInterval > 0 {
+		go ws.livenessLoop(opts.LivenessInterval)
+	}
+	if opts.SlowClientThreshold > 0 {
+		go ws.queueMonitor(opts.QueueSampleInterval)
+	}
+	if opts.LoadShedThreshold > 0 {
+		go ws.loadMonitor(opts.QueueSampleInterval)
+	}
+	if opts.MemorySoftLimit > 0 || opts.MemoryHardLimit > 0 {
+		go ws.memoryMonitor(opts.QueueSampleInterval)
+	}
+
+	return ws
+}
+
+// CloseAll sends every client a going-away close frame and closes its
+// connection. Each connection's read loop then ends and cleans up after it.
+//
+// Forwards may still be in flight while this runs. All clients are marked
+// closed before any socket is touched, so those forwards see the flag and
+// give up quietly instead of writing to a closed connection.
+func (ws *WebSocketServer) CloseAll() {
+	clients := ws.connectionManager.All()
+	for _, client := range clients {
+		client.Close()
 	}
+
+	for _, client := range clients {
+		client.sendClose(websocket.CloseGoingAway, "server shutting down")
+		client.Sender().Close()
+	}
+}
+
+// Stop ends the server's background tasks
+func (ws *WebSocketServer) Stop() {
+	ws.stopOnce.Do(func() {
+		close(ws.done)
+	})
 }
 
 // handleConnection manages a single WebSocket connection
-func (ws *WebSocketServer) handleConnection(conn *websocket.Conn) {
-	// Generate unique connection ID
-	id := uuid.New().String()
+func (ws *WebSocketServer) handleConnection(connCtx context.Context, conn *websocket.Conn, id string, origin string, resumed *resumeState) {
+	client := ws.openClient(connCtx, id, origin, websocketSender{conn}, resumed)
+	if client.Closed() {
+		ws.closeConnection(connCtx, client)
+		return
+	}
+	ws.readMessages(connCtx, client, conn)
+}
+
+// readMessages handles the messages a client sends over a WebSocket until
+// the connection ends, then cleans up after the client, unless it has since
+// moved to another transport
+func (ws *WebSocketServer) readMessages(connCtx context.Context, client *Client, conn *websocket.Conn) {
+	id := client.ID()
+	sender := websocketSender{conn}
+	conn.SetReadLimit(ws.opts.MaxMessageBytes)
+	defer func() {
+		if client.Sender() != sender {
+			sender.Close()
+			return
+		}
+		ws.closeConnection(connCtx, client)
+	}()
+
+	// Handle incoming messages
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err == errFrameRateExceeded {
+			log.Printf("[%s] Frame rate exceeded 🔥 closing connection\n", id)
+			client.sendClose(websocket.ClosePolicyViolation, "frame rate exceeded")
+			break
+		}
+		if kind := classifyProtocolError(err); kind != "" {
+			log.Printf("[%s] Protocol error (%s) 🔥 closing connection: %v\n", id, kind, err)
+			ws.metrics.protocolErrors[kind].Add(1)
+			break
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("❌ Unexpected close error: %v\n", err)
+			}
+			break
+		}
+		if messageType == websocket.TextMessage && !utf8.Valid(message) {
+			log.Printf("[%s] Protocol error (invalid_utf8) 🔥 closing connection\n", id)
+			ws.metrics.protocolErrors["invalid_utf8"].Add(1)
+			client.sendClose(websocket.CloseInvalidFramePayloadData, "invalid UTF-8 in text frame")
+			break
+		}
+
+		ws.receive(connCtx, client, message)
+
+		// The client asked to disconnect
+		if client.Closed() {
+			break
+		}
+	}
+}
+
+// openClient registers a newly connected client and welcomes it. If the
+// welcome cannot be sent the client is returned closed, and the caller is
+// left to call closeConnection as it would for any other client.
+func (ws *WebSocketServer) openClient(connCtx context.Context, id string, origin string, sender Sender, resumed *resumeState) *Client {
 	log.Printf("[%s] Client connected 🙌\n", id)
 
+	_, connectSpan := ws.tracer.Start(connCtx, "signaller.connect", connectionAttributes(id))
+
 	// Add connection to manager
-	ws.connectionManager.Add(id, conn)
-	defer ws.closeConnection(id, conn)
+	client := NewClient(id, sender, ws.opts.SendQueueSize)
+	client.origin = origin
+	if ws.opts.Dedup {
+		client.dedup = newDedupWindow(ws.opts.DedupWindow)
+	}
+	if ws.opts.RateLimit > 0 {
+		client.limiter = newTokenBucket(ws.opts.RateLimit, ws.opts.RateBurst)
+	}
+	if ws.opts.CandidateBatchWindow > 0 {
+		client.batch = newCandidateBatcher(ws.opts.CandidateBatchWindow, ws.opts.CandidateBatchSize, func(data []byte, count int) {
+			ws.write(client, data, count)
+		})
+	}
+	if resumed != nil {
+		client.Identity = resumed.identity
+	}
+	ws.connectionManager.Add(id, client)
 
 	// Send connection ID to client
-	if err := conn.WriteJSON(map[string]string{"userId": id}); err != nil {
+	if ws.opts.ResumeGrace > 0 {
+		client.resumeToken = newNonce()
+		client.resumable.Store(true)
+	}
+	welcome := ws.welcomeFor(client)
+	if resumed != nil {
+		welcome.Resumed = true
+		if ws.opts.ResumeMetadata {
+			welcome.Profile = &resumed.profile
+		}
+	}
+	err := client.WriteJSON(welcome)
+	connectSpan.End()
+	if err != nil {
 		log.Printf("❌ Failed to send user ID: %v\n", err)
+		client.Close()
+		return client
+	}
+
+	// Connections start out in the default room until they join another,
+	// unless they are resuming
+	if resumed != nil {
+		ws.restoreResumeState(client, resumed)
+	} else if ws.opts.DefaultRoom != "" {
+		ws.joinRoom(client, ws.opts.DefaultRoom, RoleParticipant, "", false)
+	}
+	return client
+}
+
+// welcomeFor builds the welcome for a client
+func (ws *WebSocketServer) welcomeFor(client *Client) WelcomeMessage {
+	welcome := WelcomeMessage{SignalType: "welcome", UserID: client.ID(), InstanceID: ws.opts.InstanceID}
+	if client.limiter != nil {
+		welcome.RateLimit = &RateLimitInfo{MessagesPerSecond: ws.opts.RateLimit, Burst: ws.opts.RateBurst}
+	}
+	welcome.RequireReady = ws.opts.RequireReady
+	if ws.opts.VerifyPayloadOrigin {
+		welcome.Origin = client.origin
+	}
+	welcome.ResumeToken = client.resumeToken
+	return welcome
+}
+
+// receive handles a message read from a client, whatever its transport
+func (ws *WebSocketServer) receive(connCtx context.Context, client *Client, message []byte) {
+	client.Touch()
+
+	if client.limiter != nil && !client.limiter.Allow() {
+		ws.metrics.messagesRateLimited.Add(1)
+		ws.sendError(client, errRateLimited)
+		return
+	}
+	if ws.limiter != nil && !ws.limiter.Allow() {
+		ws.metrics.messagesRateLimited.Add(1)
+		ws.sendError(client, errServerRateLimited)
 		return
 	}
 
-	// Handle incoming messages
-	for {
-		_, message, err := conn.ReadMessage()
+	ws.handleMessage(connCtx, client, message)
+}
+
+// handleMessage parses and acts on a single message from a client
+func (ws *WebSocketServer) handleMessage(connCtx context.Context, client *Client, message []byte) {
+	var genericMessage struct {
+		SignalType string `json:"signalType"`
+		Origin     string `json:"origin"`
+		MessageID  string `json:"messageId"`
+		TraceFields
+	}
+
+	if err := json.Unmarshal(message, &genericMessage); err != nil {
+		log.Printf("❌ Error Parsing Signal Message: %v\n", err)
+		return
+	}
+
+	// A message claiming another origin than its connection's was most
+	// likely routed here by mistake
+	if ws.opts.VerifyPayloadOrigin && genericMessage.Origin != client.origin {
+		log.Printf("[%s] Rejected %s from origin %q on a connection from %q\n", client.ID(), genericMessage.SignalType, genericMessage.Origin, client.origin)
+		ws.sendError(client, errOriginMismatch)
+		return
+	}
+
+	// Messages that carry an ID may only be sent once per replay window.
+	// The ID is remembered once the message is accepted, so that one turned
+	// away, say while the server sheds load, can be sent again.
+	sender := client.ID()
+	if ws.replays != nil && genericMessage.MessageID != "" {
+		if len(genericMessage.MessageID) > maxMessageIDBytes {
+			ws.sendError(client, errInvalidMessageID)
+			return
+		}
+		if ws.replays.Seen(sender, genericMessage.MessageID) {
+			log.Printf("[%s] Rejected replayed %s %s\n", sender, genericMessage.SignalType, genericMessage.MessageID)
+			ws.sendError(client, errReplayDetected)
+			return
+		}
+	}
 
-		var genericMessage struct {
-			SignalType string `json:"signalType"`
+	// Low priority signals are the first to go while the server is overloaded
+	if lowPrioritySignals[genericMessage.SignalType] && ws.overloaded() {
+		ws.metrics.messagesShed.Add(1)
+		ws.sendError(client, errLoadShed)
+		return
+	}
+
+	log.Println("generic message: ", genericMessage.SignalType)
+
+	ctx, span := ws.tracer.Start(genericMessage.extract(connCtx), "signaller.receive",
+		connectionAttributes(client.ID()),
+		trace.WithAttributes(attribute.String("signaller.signal_type", genericMessage.SignalType)))
+	defer span.End()
+
+	// Signals are accepted once they reach a target
+	accepted := true
+	switch genericMessage.SignalType {
+	case "offer", "answer":
+		var messageJson SignalMessageSdp
+		json.Unmarshal(message, &messageJson)
+		if err := ws.checkSDP(&messageJson); err != nil {
+			ws.sendError(client, err)
+			return
 		}
+		accepted = ws.forwardSignal(ctx, client, &messageJson.SignalEnvelope, &messageJson) != nil
 
-		err = json.Unmarshal(message, &genericMessage)
+	case "candidate", "candidate-complete":
+		var messageJson SignalMessageCandidate
+		json.Unmarshal(message, &messageJson)
+		// An empty or null candidate is the browser's end-of-candidates
+		// indication; relay it as its own signal type
+		if messageJson.Candidate == "" {
+			messageJson.SignalType = "candidate-complete"
+		}
+		accepted = ws.forwardSignal(ctx, client, &messageJson.SignalEnvelope, &messageJson) != nil
 
-		if err != nil {
-			log.Printf("❌ Error Parsing Signal Message: %v\n", err)
+	case "key-exchange":
+		var messageJson SignalMessageKeyExchange
+		json.Unmarshal(message, &messageJson)
+		if len(messageJson.Payload) > ws.opts.MaxKeyExchangeBytes {
+			ws.sendError(client, errKeyExchangeTooLarge)
+			return
 		}
+		accepted = ws.forwardSignal(ctx, client, &messageJson.SignalEnvelope, &messageJson) != nil
+
+	case "call-state":
+		accepted = ws.forwardCallState(ctx, client, message) != nil
 
-		log.Println("generic message: ", genericMessage)
+	case "presence", "typing":
+		var messageJson SignalMessageData
+		json.Unmarshal(message, &messageJson)
+		accepted = ws.forwardSignal(ctx, client, &messageJson.SignalEnvelope, &messageJson) != nil
 
-		switch genericMessage.SignalType {
-		case "offer":
-			var messageJson SignalMessageSdp
-			json.Unmarshal(message, &messageJson)
-			ws.forwardSignalSdp(id, messageJson)
+	case "join":
+		var messageJson RoomMessage
+		json.Unmarshal(message, &messageJson)
+		ws.joinRoom(client, messageJson.Room, messageJson.Role, messageJson.Password, messageJson.Deltas)
 
-		case "answer":
-			var messageJson SignalMessageSdp
-			json.Unmarshal(message, &messageJson)
-			ws.forwardSignalSdp(id, messageJson)
+	case "leave":
+		ws.leaveRoom(client)
 
-		case "candidate":
-			var messageJson SignalMessageCandidate
-			json.Unmarshal(message, &messageJson)
-			ws.forwardSignalCandidate(id, messageJson)
+	case "createRoom":
+		var messageJson CreateRoomMessage
+		json.Unmarshal(message, &messageJson)
+		ws.createRoom(client, messageJson.RoomOptions)
 
+	case "matchmake":
+		var messageJson MatchmakeMessage
+		json.Unmarshal(message, &messageJson)
+		ws.matchmake(client, messageJson.Criteria)
+
+	case "matchmake-cancel":
+		if ws.matchmaker.Cancel(client.ID()) {
+			log.Printf("[%s] Left matchmaking\n", client.ID())
+		}
+
+	case "listRooms":
+		rooms := map[string]interface{}{"signalType": "rooms", "rooms": ws.roomManager.Public()}
+		if err := client.WriteJSON(rooms); err != nil {
+			log.Printf("❌ Failed to send room list: %v\n", err)
+		}
+
+	case "broadcast":
+		var messageJson BroadcastMessage
+		json.Unmarshal(message, &messageJson)
+		ws.broadcastSignal(client, &messageJson)
+
+	case "sdp-reset":
+		// Candidates resent for the new negotiation must not be taken for
+		// repeats of the ones sent before it
+		if ws.opts.DedupPerGeneration {
+			generation := client.generation.Add(1)
+			log.Printf("[%s] Started negotiation generation %d\n", client.ID(), generation)
 		}
 
+	case "disconnect":
+		ws.disconnect(client)
+
+	case "capabilities":
+		var messageJson CapabilitiesMessage
+		json.Unmarshal(message, &messageJson)
+		ws.setCapabilities(client, &messageJson)
+
+	case "set-metadata":
+		var messageJson ProfileMessage
+		json.Unmarshal(message, &messageJson)
+		ws.setProfile(client, messageJson.ConnectionProfile)
+
+	case "ready":
+		client.ready.Store(true)
+		log.Printf("[%s] Ready ✅\n", client.ID())
+
+	case "pause":
+		client.Pause()
+		log.Printf("[%s] Paused ⏸️\n", client.ID())
+		if err := client.WriteJSON(map[string]string{"signalType": "paused"}); err != nil {
+			log.Printf("❌ Failed to confirm pause: %v\n", err)
+		}
+
+	case "resume":
+		delivered, err := client.Resume()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-				log.Printf("❌ Unexpected close error: %v\n", err)
+			log.Printf("❌ Failed to deliver held signals after %d: %v\n", delivered, err)
+			ws.sendError(client, errResumeIncomplete)
+			return
+		}
+		log.Printf("[%s] Resumed ▶️ with %d held signals\n", client.ID(), delivered)
+		if err := client.WriteJSON(map[string]interface{}{"signalType": "resumed", "delivered": delivered}); err != nil {
+			log.Printf("❌ Failed to confirm resume: %v\n", err)
+		}
+
+	case "upgrade-identity":
+		var messageJson UpgradeIdentityMessage
+		json.Unmarshal(message, &messageJson)
+		ws.upgradeIdentity(client, messageJson.Token)
+
+	}
+
+	if accepted && ws.replays != nil && genericMessage.MessageID != "" {
+		ws.replays.Record(sender, genericMessage.MessageID)
+	}
+}
+
+// checkSDP applies the configured policy and munging to an offer or answer
+// before it is forwarded
+func (ws *WebSocketServer) checkSDP(message *SignalMessageSdp) error {
+	munge := len(ws.opts.SDPStripCodecs) > 0 || ws.opts.SDPBandwidth > 0
+	if !ws.opts.RequireDTLS && !munge {
+		return nil
+	}
+	// Decoding and parsing take time in proportion to the SDP, so past the
+	// configured size it is forwarded as is
+	if ws.opts.SDPValidationMaxBytes > 0 && len(message.SDP) > ws.opts.SDPValidationMaxBytes {
+		ws.metrics.sdpValidationsSkipped.Add(1)
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		ws.metrics.sdpValidations.Add(1)
+		ws.metrics.sdpValidationNanos.Add(int64(time.Since(start)))
+	}()
+
+	sdp, err := decodeSDP(message.SDP)
+	if err != nil {
+		return errInvalidSDP
+	}
+	if ws.opts.RequireDTLS && !isSecureSDP(sdp) {
+		return errInsecureSDP
+	}
+
+	if munge {
+		session := parseSDP(sdp)
+		if len(ws.opts.SDPStripCodecs) > 0 {
+			session.RemoveCodecs(ws.opts.SDPStripCodecs)
+		}
+		if ws.opts.SDPBandwidth > 0 {
+			session.SetBandwidth(ws.opts.SDPBandwidth)
+		}
+		message.SDP = base64.StdEncoding.EncodeToString([]byte(session.String()))
+	}
+	return nil
+}
+
+// resolveTarget finds the connection a signal is addressed to. peerIndex
+// takes precedence over identity, which takes precedence over userId.
+// peerIndex is resolved against the sender's room at forward time, so it
+// always refers to the current roster.
+func (ws *WebSocketServer) resolveTarget(sender *Client, envelope *SignalEnvelope) (*Client, error) {
+	targetID := envelope.UserID
+
+	if envelope.Identity != "" && envelope.PeerIndex == nil {
+		targetConn, exists := ws.connectionManager.MostRecent(envelope.Identity)
+		if !exists {
+			return nil, errIdentityNotFound
+		}
+		return targetConn, nil
+	}
+
+	if envelope.PeerIndex != nil {
+		room, ok := ws.roomManager.RoomOf(sender.ID())
+		if !ok {
+			return nil, errNotInRoom
+		}
+		targetID, ok = ws.roomManager.MemberAt(room, *envelope.PeerIndex)
+		if !ok {
+			return nil, errPeerIndexOutOfRange
+		}
+	}
+
+	targetConn, exists := ws.connectionManager.Resolve(targetID)
+	if !exists {
+		return nil, errTargetNotFound
+	}
+	return targetConn, nil
+}
+
+// forwardSignal routes signaling messages between clients and returns the
+// clients it was forwarded to. envelope must point into message so that
+// rewriting it changes what is sent.
+func (ws *WebSocketServer) forwardSignal(ctx context.Context, sender *Client, envelope *SignalEnvelope, message interface{}) []*Client {
+	ctx, span := ws.tracer.Start(ctx, "signaller.forward",
+		connectionAttributes(sender.ID()),
+		trace.WithAttributes(attribute.String("signaller.signal_type", envelope.SignalType)))
+	defer span.End()
+
+	if !ws.isReady(sender) {
+		ws.sendError(sender, errNotReady)
+		return nil
+	}
+
+	if ws.roomManager.RoleOf(sender.ID()) == RoleSpectator {
+		ws.sendError(sender, errSpectator)
+		return nil
+	}
+
+	if err := ws.checkMetadata(envelope.Metadata); err != nil {
+		ws.sendError(sender, err)
+		return nil
+	}
+
+	envelope.Hops++
+	if ws.opts.MaxHops > 0 && envelope.Hops > ws.opts.MaxHops {
+		log.Printf("[%s] Dropped %s after %d hops\n", sender.ID(), envelope.SignalType, envelope.Hops-1)
+		ws.sendError(sender, errHopLimitExceeded)
+		return nil
+	}
+
+	targets := envelope.UserIDs
+	envelope.UserIDs = nil
+	fallbacks := envelope.Fallbacks
+	envelope.Fallbacks = nil
+	if len(fallbacks) > 0 {
+		if len(targets) > 0 {
+			ws.sendError(sender, errFallbacksAndTargets)
+			return nil
+		}
+		if len(fallbacks) >= ws.opts.MaxTargets {
+			ws.sendError(sender, errTooManyTargets)
+			return nil
+		}
+		if targetConn := ws.forwardWithFallbacks(ctx, span, sender, envelope, message, fallbacks); targetConn != nil {
+			return []*Client{targetConn}
+		}
+		return nil
+	}
+	if len(targets) == 0 {
+		if targetConn := ws.forwardTo(ctx, span, sender, envelope, message, ""); targetConn != nil {
+			return []*Client{targetConn}
+		}
+		return nil
+	}
+	if len(targets) > ws.opts.MaxTargets {
+		ws.sendError(sender, errTooManyTargets)
+		return nil
+	}
+
+	// Each target is checked, deduplicated and delivered to on its own, so
+	// the same candidate sent to every peer counts once per peer
+	span.SetAttributes(attribute.StringSlice("signaller.target_ids", targets))
+	var forwarded []*Client
+	for _, target := range targets {
+		envelope.UserID = target
+		envelope.Identity = ""
+		envelope.PeerIndex = nil
+		if targetConn := ws.forwardTo(ctx, span, sender, envelope, message, target); targetConn != nil {
+			forwarded = append(forwarded, targetConn)
+		}
+	}
+	return forwarded
+}
+
+// forwardWithFallbacks delivers a signal to the first of its target and
+// fallbacks that is online and confirms to the sender which one that was
+func (ws *WebSocketServer) forwardWithFallbacks(ctx context.Context, span trace.Span, sender *Client, envelope *SignalEnvelope, message interface{}, fallbacks []string) *Client {
+	for i := 0; ; i++ {
+		// Move on while the target is offline, but leave the last one for
+		// forwardTo to fail on
+		if i < len(fallbacks) {
+			targetConn, err := ws.resolveTarget(sender, envelope)
+			if err == errTargetNotFound || err == errIdentityNotFound || (err == nil && targetConn.Closed()) {
+				envelope.UserID = fallbacks[i]
+				envelope.Identity = ""
+				envelope.PeerIndex = nil
+				continue
 			}
-			break
 		}
+
+		signalType := envelope.SignalType
+		targetConn := ws.forwardTo(ctx, span, sender, envelope, message, "")
+		if targetConn == nil {
+			return nil
+		}
+		confirmation := DeliveredMessage{SignalType: "delivered", Signal: signalType, To: targetConn.ID(), Fallback: i > 0}
+		if err := sender.WriteJSON(confirmation); err != nil {
+			log.Printf("❌ Failed to confirm delivery: %v\n", err)
+		}
+		return targetConn
 	}
 }
 
-// forwardSignal routes signaling messages between clients
-func (ws *WebSocketServer) forwardSignalSdp(senderID string, message SignalMessageSdp) {
-	// Preserve targetId in a variable
-	targetID := message.UserID
+// forwardTo delivers a signal that passed forwardSignal's checks to the
+// target its envelope addresses and returns that target, or nil if it could
+// not be. Errors name target, which is only set for signals sent to several
+// targets.
+func (ws *WebSocketServer) forwardTo(ctx context.Context, span trace.Span, sender *Client, envelope *SignalEnvelope, message interface{}, target string) *Client {
+	// Get target connection
+	targetConn, err := ws.resolveTarget(sender, envelope)
+	if err != nil {
+		log.Printf("❌ Failed to resolve target for %s: %v\n", sender.ID(), err)
+		span.SetStatus(codes.Error, err.Error())
+		ws.sendErrorFor(sender, err, target)
+		return nil
+	}
+	if target == "" {
+		span.SetAttributes(attribute.String("signaller.target_id", targetConn.ID()))
+	}
+
+	if !ws.relayAllowed(sender.ID(), targetConn.ID()) {
+		span.SetStatus(codes.Error, errRelayDenied.Error())
+		ws.sendErrorFor(sender, errRelayDenied, target)
+		return nil
+	}
+
+	// Offers and answers lose the codecs the target cannot receive. The
+	// same message may go to other targets next, so the SDP is put back.
+	if sdpMessage, ok := message.(*SignalMessageSdp); ok && ws.opts.SDPCapabilities {
+		original := sdpMessage.SDP
+		sdpMessage.SDP = ws.adaptSDP(original, targetConn)
+		defer func() { sdpMessage.SDP = original }()
+	}
 
 	// Modify message to include sender's ID
-	message.UserID = senderID
+	envelope.UserID = sender.ID()
+	envelope.Identity = ""
+	envelope.PeerIndex = nil
+	envelope.InstanceID = ws.forwardInstanceID()
+	var traceFields TraceFields
+	traceFields.inject(ctx)
+	envelope.TraceFields = TraceFields{}
 
-	// Get target connection
-	targetConn, exists := ws.connectionManager.Get(targetID)
-	if !exists {
-		log.Printf("❌ Target connection not found: %s\n", message.UserID)
+	var data []byte
+	if keyExchange, ok := message.(*SignalMessageKeyExchange); ok {
+		data, err = keyExchange.encode()
+	} else {
+		data, err = json.Marshal(message)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to encode message: %v\n", err)
+		return nil
+	}
+
+	ws.inRoomOrder(ws.sharedRoom(sender.ID(), targetConn.ID()), func(seq uint64) {
+		ws.deliver(sender, targetConn, envelope.SignalType, data, seq, traceFields)
+	})
+	return targetConn
+}
+
+// broadcastSignal relays a client's broadcast to the rest of its room
+func (ws *WebSocketServer) broadcastSignal(sender *Client, message *BroadcastMessage) {
+	if !ws.isReady(sender) {
+		ws.sendError(sender, errNotReady)
+		return
+	}
+	room, ok := ws.roomManager.RoomOf(sender.ID())
+	if !ok {
+		ws.sendError(sender, errNotInRoom)
+		return
+	}
+	if ws.roomManager.RoleOf(sender.ID()) == RoleSpectator {
+		ws.sendError(sender, errSpectator)
+		return
+	}
+	if err := ws.checkMetadata(message.Metadata); err != nil {
+		ws.sendError(sender, err)
 		return
 	}
 
-	// Forward message
-	if err := targetConn.WriteJSON(message); err != nil {
+	message.UserID = sender.ID()
+	message.InstanceID = ws.forwardInstanceID()
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("❌ Failed to encode message: %v\n", err)
+		return
+	}
+
+	ws.inRoomOrder(room, func(seq uint64) {
+		for _, member := range ws.roomManager.Members(room) {
+			if member == sender.ID() || !ws.relayAllowed(sender.ID(), member) {
+				continue
+			}
+			if memberConn, exists := ws.connectionManager.Get(member); exists {
+				ws.deliver(sender, memberConn, message.SignalType, data, seq, TraceFields{})
+			}
+		}
+	})
+}
+
+// checkMetadata validates the metadata attached to a signal. The server never
+// looks inside it beyond checking that it is a reasonably small object.
+func (ws *WebSocketServer) checkMetadata(metadata json.RawMessage) error {
+	if metadata == nil || string(metadata) == "null" {
+		return nil
+	}
+	if len(metadata) > ws.opts.MaxMetadataBytes {
+		return errMetadataTooLarge
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &object); err != nil || object == nil {
+		return errInvalidMetadata
+	}
+	return nil
+}
+
+// isReady reports whether a client may send signals, which with
+// -require-ready is only once it has sent "ready"
+func (ws *WebSocketServer) isReady(client *Client) bool {
+	return !ws.opts.RequireReady || client.ready.Load()
+}
+
+// forwardInstanceID is the instance ID stamped on forwarded signals, if any.
+// Whatever the sender put there is always overwritten.
+func (ws *WebSocketServer) forwardInstanceID() string {
+	if ws.opts.StampInstanceID {
+		return ws.opts.InstanceID
+	}
+	return ""
+}
+
+// write queues an encoded message carrying count signals for target and
+// counts them as forwarded or dropped
+func (ws *WebSocketServer) write(target *Client, data []byte, count int) bool {
+	if err := target.Forward(data, ws.holdLimit()); err != nil {
+		if err == errClientClosed {
+			return false
+		}
+		if err == errSendQueueFull || err == errPauseQueueFull {
+			ws.metrics.messagesDropped.Add(int64(count))
+		}
 		log.Printf("❌ Failed to forward message: %v\n", err)
+		return false
 	}
+	ws.metrics.messagesForwarded.Add(int64(count))
+	return true
 }
 
-func (ws *WebSocketServer) forwardSignalCandidate(senderID string, message SignalMessageCandidate) {
-	// Preserve targetId in a variable
-	targetID := message.UserID
+// deliver writes an encoded signal from sender to target, stamped with seq
+// if it is ordered and with the trace context of the forward
+func (ws *WebSocketServer) deliver(sender *Client, target *Client, signalType string, data []byte, seq uint64, traceFields TraceFields) {
+	// Drop exact repeats of something this target was recently sent
+	if target.dedup != nil && target.dedup.Seen(sender.generation.Load(), data) {
+		log.Printf("[%s] Dropped duplicate %s for %s\n", sender.ID(), signalType, target.ID())
+		return
+	}
+
+	// Every delivery gets a nonce of its own, after dedup has looked at
+	// the signal as sent
+	if ws.opts.StampNonces {
+		data = stampNonce(data)
+	}
+	data = stampSequence(data, seq)
+	data = traceFields.stamp(data)
 
-	// Modify message to include sender's ID
-	message.UserID = senderID
+	// Forward message, candidates by way of the target's batch if it has
+	// one. Ordered candidates are not batched, as a batch would be sent
+	// after whatever the room sends in the meantime.
+	switch {
+	case target.batch != nil && signalType == "candidate" && seq == 0:
+		target.batch.Add(data)
+	case target.batch != nil:
+		target.batch.Flush()
+		fallthrough
+	default:
+		if !ws.write(target, data, 1) {
+			return
+		}
+	}
 
-	// Get target connection
-	targetConn, exists := ws.connectionManager.Get(targetID)
-	if !exists {
-		log.Printf("❌ Target connection not found: %s\n", message.UserID)
+	if ws.opts.ReplaySink != nil {
+		ws.opts.ReplaySink.Record(ReplayEntry{
+			Time:    time.Now(),
+			From:    sender.ID(),
+			To:      target.ID(),
+			Message: sanitizeMessage(data),
+		})
+	}
+}
+
+// sendError reports a rejected signal to its sender
+func (ws *WebSocketServer) sendError(client *Client, err error) {
+	ws.sendErrorFor(client, err, "")
+}
+
+// sendErrorFor reports an error about one of the targets of a signal
+func (ws *WebSocketServer) sendErrorFor(client *Client, err error, target string) {
+	signalErr, ok := err.(*SignalError)
+	if !ok {
+		signalErr = &SignalError{"internal_error", err.Error()}
+	}
+	message := ErrorMessage{
+		SignalType: "error",
+		Error:      signalErr.Code,
+		Message:    signalErr.Message,
+		Target:     target,
+	}
+	if err := client.WriteJSON(message); err != nil {
+		log.Printf("❌ Failed to send error: %v\n", err)
+	}
+}
+
+// createRoom creates a room with client chosen options and sends back its
+// name. The creator still has to join it like everyone else.
+func (ws *WebSocketServer) createRoom(client *Client, options RoomOptions) {
+	if options.MaxMembers < 0 {
+		ws.sendError(client, errInvalidRoomOptions)
 		return
 	}
 
-	// Forward message
-	if err := targetConn.WriteJSON(message); err != nil {
-		log.Printf("❌ Failed to forward message: %v\n", err)
+	room := ws.roomManager.Create(options)
+	log.Printf("[%s] Created room %s\n", client.ID(), room)
+
+	if err := client.WriteJSON(map[string]string{"signalType": "room_created", "room": room}); err != nil {
+		log.Printf("❌ Failed to send room handle: %v\n", err)
+	}
+}
+
+// joinRoom moves a client into a room and notifies both rooms involved.
+// Whether the client gets roster deltas only changes once it is in.
+func (ws *WebSocketServer) joinRoom(client *Client, room string, role string, password string, deltas bool) {
+	if room == "" {
+		return
 	}
+	switch role {
+	case "":
+		role = RoleParticipant
+	case RoleParticipant, RoleSpectator:
+	default:
+		ws.sendError(client, errInvalidRole)
+		return
+	}
+
+	members, previous, err := ws.roomManager.Join(room, client.ID(), role, password)
+	if err == nil {
+		client.deltas.Store(deltas)
+	}
+	ws.joined(client, room, role, members, previous, err)
+}
+
+// joined tells a client the outcome of putting it into a room and, if that
+// worked, notifies both rooms involved
+func (ws *WebSocketServer) joined(client *Client, room string, role string, members []string, previous string, err error) {
+	if err != nil {
+		ws.sendError(client, err)
+		return
+	}
+	if previous != "" {
+		ws.notifyMembership(previous, "peer_left", client.ID())
+	}
+	log.Printf("[%s] Joined room %s\n", client.ID(), room)
+
+	if err := client.WriteJSON(RoomEvent{SignalType: "joined", Room: room, Role: role, Members: members}); err != nil {
+		log.Printf("❌ Failed to send room roster: %v\n", err)
+	}
+	ws.notifyMembership(room, "peer_joined", client.ID())
+}
+
+// matchmake queues a client until a peer with compatible criteria comes
+// along, then puts both into a new private room of their own
+func (ws *WebSocketServer) matchmake(client *Client, criteria MatchCriteria) {
+	for {
+		peerID, matched := ws.matchmaker.Enqueue(client.ID(), criteria)
+		if !matched {
+			log.Printf("[%s] Waiting for a match\n", client.ID())
+			if err := client.WriteJSON(map[string]string{"signalType": "match_queued"}); err != nil {
+				log.Printf("❌ Failed to confirm matchmaking: %v\n", err)
+			}
+			return
+		}
+
+		// The peer may have disconnected just as it was matched, in which
+		// case look for another one
+		peer, exists := ws.connectionManager.Get(peerID)
+		if !exists || peer.Closed() {
+			continue
+		}
+
+		room := ws.roomManager.Create(RoomOptions{MaxMembers: 2, Private: true})
+		log.Printf("[%s] Matched with %s in room %s\n", client.ID(), peerID, room)
+		ws.joinRoom(peer, room, RoleParticipant, "", peer.deltas.Load())
+		ws.joinRoom(client, room, RoleParticipant, "", client.deltas.Load())
+
+		for _, pair := range [][2]*Client{{client, peer}, {peer, client}} {
+			match := map[string]string{"signalType": "match_found", "room": room, "peerId": pair[1].ID()}
+			if err := pair[0].WriteJSON(match); err != nil {
+				log.Printf("❌ Failed to send match: %v\n", err)
+			}
+		}
+		return
+	}
+}
+
+// leaveRoom removes a client from its room and notifies the remaining members
+func (ws *WebSocketServer) leaveRoom(client *Client) {
+	room, _, ok := ws.roomManager.Leave(client.ID())
+	if !ok {
+		return
+	}
+	log.Printf("[%s] Left room %s\n", client.ID(), room)
+	ws.notifyMembership(room, "peer_left", client.ID())
+}
+
+// notifyMembership tells a room that a member joined or left, debounced
+// when MembershipDebounce is set
+func (ws *WebSocketServer) notifyMembership(room string, signalType string, id string) {
+	if ws.membership != nil {
+		ws.membership.Notify(room, signalType, id)
+		return
+	}
+	ws.emitMembership(room, signalType, id)
+}
+
+// emitMembership sends a peer_joined or peer_left event with the room's
+// current roster, or just the change to members that asked for deltas.
+// With MembershipBatch the change waits for the room's next batch instead.
+func (ws *WebSocketServer) emitMembership(room string, signalType string, id string) {
+	if ws.membershipBatch != nil {
+		ws.membershipBatch.Add(room, signalType, id)
+		return
+	}
+
+	event := RoomEvent{SignalType: signalType, Room: room, UserID: id, Members: ws.roomManager.Members(room)}
+	delta := PeerListDelta{SignalType: "peer_list_changed", Room: room, Added: []string{}, Removed: []string{}}
+	if signalType == "peer_joined" {
+		event.Role = ws.roomManager.RoleOf(id)
+		delta.Added = append(delta.Added, id)
+	} else {
+		delta.Removed = append(delta.Removed, id)
+	}
+
+	ws.broadcastToRoomEach(room, id, func(member *Client) interface{} {
+		if member.deltas.Load() {
+			return delta
+		}
+		return event
+	})
+}
+
+// emitMembershipBatch sends a room a batch of membership changes: a
+// peers_changed event with the room's current roster, or just the changes to
+// members that asked for deltas. Members are not told about themselves.
+func (ws *WebSocketServer) emitMembershipBatch(room string, added []string, removed []string) {
+	members := ws.roomManager.Members(room)
+	if removed == nil {
+		removed = []string{}
+	}
+	ws.broadcastToRoomEach(room, "", func(member *Client) interface{} {
+		memberAdded := withoutID(added, member.ID())
+		if len(memberAdded) == 0 && len(removed) == 0 {
+			return nil
+		}
+		if member.deltas.Load() {
+			return PeerListDelta{SignalType: "peer_list_changed", Room: room, Added: memberAdded, Removed: removed}
+		}
+		return PeersChangedEvent{SignalType: "peers_changed", Room: room, Added: memberAdded, Removed: removed, Members: members}
+	})
+}
+
+// withoutID returns ids without id
+func withoutID(ids []string, id string) []string {
+	without := make([]string, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			without = append(without, other)
+		}
+	}
+	return without
+}
+
+// roomClosed tells the former members of a room the server closed that they
+// are no longer in it
+func (ws *WebSocketServer) roomClosed(room string, members []string, reason string) {
+	log.Printf("Closed room %s: %s\n", room, reason)
+
+	event := RoomEvent{SignalType: "room_closed", Room: room, Reason: reason, Members: []string{}}
+	for _, member := range members {
+		memberConn, exists := ws.connectionManager.Get(member)
+		if !exists {
+			continue
+		}
+		if err := memberConn.WriteJSON(event); err != nil && err != errClientClosed {
+			log.Printf("❌ Failed to notify %s: %v\n", member, err)
+		}
+	}
+}
+
+// broadcastRoomEvent sends a membership change to every member of a room
+// except the one it is about
+func (ws *WebSocketServer) broadcastRoomEvent(room string, signalType string, userID string, members []string) {
+	event := RoomEvent{SignalType: signalType, Room: room, UserID: userID, Members: members}
+	ws.broadcastToRoom(room, userID, event)
+}
+
+// broadcastToRoom sends a message to every member of a room except exclude
+func (ws *WebSocketServer) broadcastToRoom(room string, exclude string, message interface{}) {
+	ws.broadcastToRoomEach(room, exclude, func(*Client) interface{} {
+		return message
+	})
+}
+
+// broadcastToRoomEach sends every member of a room except exclude the
+// message picked for it, if any
+func (ws *WebSocketServer) broadcastToRoomEach(room string, exclude string, messageFor func(member *Client) interface{}) {
+	ws.inRoomOrder(room, func(seq uint64) {
+		for _, member := range ws.roomManager.Members(room) {
+			if member == exclude {
+				continue
+			}
+			memberConn, exists := ws.connectionManager.Get(member)
+			if !exists {
+				continue
+			}
+			message := messageFor(memberConn)
+			if message == nil {
+				continue
+			}
+			data, err := json.Marshal(message)
+			if err == nil {
+				err = memberConn.WriteMessage(stampSequence(data, seq))
+			}
+			if err != nil && err != errClientClosed {
+				log.Printf("❌ Failed to notify %s: %v\n", member, err)
+			}
+		}
+	})
+}
+
+// upgradeIdentity rebinds an anonymous connection to the identity carried by
+// a valid token. The connection keeps its place in its room; the other
+// members are told about the new ID. An identity may be bound to several
+// connections at once, e.g. one per device.
+func (ws *WebSocketServer) upgradeIdentity(client *Client, token string) {
+	if ws.opts.IdentitySecret == "" {
+		ws.sendError(client, errIdentityDisabled)
+		return
+	}
+	identity, ok := verifyIdentityToken(ws.opts.IdentitySecret, token)
+	if !ok {
+		ws.sendError(client, errInvalidToken)
+		return
+	}
+
+	oldID := client.ID()
+	newID, ok := ws.connectionManager.BindIdentity(oldID, identity)
+	if !ok {
+		return
+	}
+	if newID != oldID {
+		ws.roomManager.Rename(oldID, newID)
+		ws.matchmaker.Rename(oldID, newID)
+	}
+	log.Printf("[%s] Upgraded identity to %s as %s\n", oldID, identity, newID)
+
+	confirmation := map[string]string{"signalType": "identity_upgraded", "userId": newID, "identity": identity}
+	if err := client.WriteJSON(confirmation); err != nil {
+		log.Printf("❌ Failed to confirm identity upgrade: %v\n", err)
+	}
+
+	if room, ok := ws.roomManager.RoomOf(newID); ok && newID != oldID {
+		event := RoomEvent{
+			SignalType: "peer_id_changed",
+			Room:       room,
+			UserID:     newID,
+			PreviousID: oldID,
+			Members:    ws.roomManager.Members(room),
+		}
+		ws.broadcastToRoom(room, newID, event)
+	}
+}
+
+// livenessLoop periodically sends every room its current roster so that
+// clients can recover from peer_joined/peer_left events they missed, e.g.
+// while reconnecting
+func (ws *WebSocketServer) livenessLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			for room, members := range ws.roomManager.Snapshot() {
+				ws.broadcastRoomEvent(room, "liveness", "", members)
+			}
+		}
+	}
+}
+
+// queueMonitor samples every client's send queue depth to keep its moving
+// average up to date and flag clients that are consistently slow to drain
+func (ws *WebSocketServer) queueMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			for _, client := range ws.connectionManager.All() {
+				if client.sampleQueueDepth(ws.opts.SlowClientThreshold) {
+					log.Printf("[%s] Client is slow to drain its queue 🐢 (avg depth %.1f)\n", client.ID(), client.QueueDepthAvg())
+				}
+			}
+		}
+	}
+}
+
+// disconnect tears a connection down at the client's request. It leaves its
+// room and matchmaking straight away, so peers get peer_left before the socket
+// goes, and is sent a normal close frame. The read loop then ends and
+// closeConnection finishes the cleanup.
+func (ws *WebSocketServer) disconnect(client *Client) {
+	log.Printf("[%s] Disconnect requested 👋\n", client.ID())
+	client.resumable.Store(false)
+	ws.leaveRoom(client)
+	ws.matchmaker.Cancel(client.ID())
+	client.Close()
+
+	client.sendClose(websocket.CloseNormalClosure, "disconnect requested")
 }
 
 // closeConnection handles connection cleanup
-func (ws *WebSocketServer) closeConnection(id string, conn *websocket.Conn) {
-	log.Printf("[%s] Connection closed 🔥\n", id)
-	conn.Close()
-	ws.connectionManager.Remove(id)
+func (ws *WebSocketServer) closeConnection(connCtx context.Context, client *Client) {
+	_, span := ws.tracer.Start(connCtx, "signaller.disconnect", connectionAttributes(client.ID()))
+	defer span.End()
+
+	log.Printf("[%s] Connection closed 🔥\n", client.ID())
+	ws.saveResumeState(client)
+	ws.leaveRoom(client)
+	ws.matchmaker.Cancel(client.ID())
+	client.Close()
+	client.Sender().Close()
+	ws.connectionManager.Remove(client.ID())
+}
+
+// routes returns the HTTP handler for all of the server's endpoints
+func (ws *WebSocketServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", ws.handleWebSocket)
+	if ws.opts.LongPoll {
+		mux.HandleFunc("/poll", ws.handlePoll)
+	}
+	if ws.opts.SSE {
+		mux.HandleFunc("/events", ws.handleEvents)
+	}
+	mux.HandleFunc("/metrics", ws.handleMetrics)
+	mux.HandleFunc("/admin/config", ws.requireAdmin(ws.handleAdminConfig))
+	mux.HandleFunc("/admin/slow-clients", ws.requireAdmin(ws.handleAdminSlowClients))
+	mux.HandleFunc("/admin/connections", ws.requireAdmin(ws.handleAdminConnections))
+	mux.HandleFunc("/admin/", ws.requireAdmin(ws.handleAdminNotFound))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	return mux
 }
 
 // handleWebSocket is the HTTP handler for WebSocket connections
 func (ws *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if client, ok := ws.handoffFor(r); ok {
+		conn, err := ws.upgrade(w, r)
+		if err != nil {
+			log.Printf("❌ Failed to upgrade to WebSocket: %v\n", err)
+			return
+		}
+		if ws.handoff(client, websocketSender{conn}) {
+			ws.readMessages(requestTraceContext(r), client, conn)
+			return
+		}
+		conn.Close()
+		return
+	}
+
+	id, resumed, ok := ws.acceptConnection(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := ws.upgrade(w, r)
 	if err != nil {
 		log.Printf("❌ Failed to upgrade to WebSocket: %v\n", err)
 		return
 	}
-	ws.handleConnection(conn)
+	ws.handleConnection(requestTraceContext(r), conn, id, requestOrigin(r), resumed)
+}
+
+// requestOrigin is the origin a connection is opened from: its Origin
+// header, or for clients that send none, such as native apps, the host they
+// connected to
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	return r.Host
+}
+
+// checkOrigin only lets browsers on one of the allowed origins connect.
+// Requests without an Origin header do not come from a browser and are let
+// through.
+func (ws *WebSocketServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range ws.opts.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens the listener the server accepts connections on: a Unix
+// domain socket when one is configured, TCP otherwise
+func listen(opts Options) (net.Listener, error) {
+	if opts.UnixSocket == "" {
+		return net.Listen("tcp", opts.Addr)
+	}
+
+	// A socket file left behind by a previous run that did not shut down
+	// cleanly would make Listen fail. Only a socket nothing answers on is
+	// stale; one a running server still accepts connections on is in use.
+	if info, err := os.Stat(opts.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", opts.UnixSocket, time.Second)
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			if err == nil {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("listen unix %s: %w", opts.UnixSocket, syscall.EADDRINUSE)
+		}
+		if err := os.Remove(opts.UnixSocket); err != nil {
+			return nil, err
+		}
+	}
+	// The listener unlinks the socket file when it is closed
+	return net.Listen("unix", opts.UnixSocket)
 }
 
 func main() {
-	server := NewWebSocketServer()
+	opts := parseOptions()
+
+	if opts.ReplayLog != "" {
+		sink, err := NewFileReplaySink(opts.ReplayLog, opts.ReplayBuffer)
+		if err != nil {
+			log.Fatalf("Failed to open replay log: %v", err)
+		}
+		defer sink.Close()
+		opts.ReplaySink = sink
+	}
+
+	if opts.OTLPEndpoint != "" {
+		provider, err := newOTLPTracerProvider(context.Background(), opts.OTLPEndpoint, opts.InstanceID)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		defer provider.Shutdown(context.Background())
+		opts.TracerProvider = provider
+	}
 
-	http.HandleFunc("/ws", server.handleWebSocket)
+	// With tenants, every tenant has a server of its own behind TLS
+	var server interface {
+		Stop()
+		CloseAll()
+	}
+	var handler http.Handler
+	var tlsConfig *tls.Config
+	if opts.Tenants != "" {
+		tenants, err := loadTenants(opts.Tenants)
+		if err != nil {
+			log.Fatalf("Failed to load tenants: %v", err)
+		}
+		router, err := NewTenantRouter(opts, tenants)
+		if err != nil {
+			log.Fatalf("Failed to set up tenants: %v", err)
+		}
+		server, handler, tlsConfig = router, router, router.TLSConfig()
+	} else {
+		signaller := NewWebSocketServer(opts)
+		server, handler = signaller, signaller.routes()
+	}
+	httpServer := &http.Server{Handler: handler}
 
-	log.Println("WebSocket server started on ws://localhost:8080/ws")
+	listener, err := listen(opts)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	log.Printf("WebSocket server started on %s\n", listener.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down 👋")
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("❌ Failed to shut down cleanly: %v\n", err)
+		}
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+
+	// Shutdown does not touch hijacked connections, so close the
+	// WebSockets explicitly
+	server.Stop()
+	server.CloseAll()
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCandidateComplete(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	for _, candidate := range []interface{}{nil, ""} {
+		a.send(map[string]interface{}{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+		message := b.read()
+		if message["signalType"] != "candidate-complete" || message["userId"] != a.id {
+			t.Fatalf("candidate %#v arrived as %v", candidate, message)
+		}
+	}
+
+	a.send(map[string]interface{}{"signalType": "candidate", "userId": b.id, "candidate": "candidate:1"})
+	if message := b.read(); message["signalType"] != "candidate" {
+		t.Fatalf("candidate arrived as %v", message["signalType"])
+	}
+}
+
+func TestInstanceIDInWelcome(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{InstanceID: "i-1"}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	if a.welcome["instanceId"] != "i-1" {
+		t.Fatalf("welcome %v lacks the instance ID", a.welcome)
+	}
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "instanceId": "spoofed"})
+	if message := b.readType("offer"); message["instanceId"] != nil {
+		t.Fatalf("forward stamped with %v without -stamp-instance-id", message["instanceId"])
+	}
+}
+
+func TestStampInstanceID(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{InstanceID: "i-1", StampInstanceID: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "instanceId": "spoofed"})
+	if message := b.readType("offer"); message["instanceId"] != "i-1" {
+		t.Fatalf("forward stamped with %v, want i-1", message["instanceId"])
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signaller.sock")
+	listener, err := listen(Options{UnixSocket: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebSocketServer(Options{})
+	httpServer := &http.Server{Handler: ws.routes()}
+	go httpServer.Serve(listener)
+	defer ws.CloseAll()
+
+	dialer := websocket.Dialer{NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}
+	dialUnix := func() *testClient {
+		conn, _, err := dialer.Dial("ws://signaller/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		client := newTestClient(t, conn)
+		client.id = client.readType("welcome")["userId"].(string)
+		return client
+	}
+	a := dialUnix()
+	b := dialUnix()
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA=="})
+	if message := b.readType("offer"); message["userId"] != a.id {
+		t.Fatalf("offer from %v, want %s", message["userId"], a.id)
+	}
+
+	if err := httpServer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind after shutdown: %v", err)
+	}
+}
+
+func TestUnixSocketReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signaller.sock")
+	// A listener whose file is not unlinked, as after a crash
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen(Options{UnixSocket: path})
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	listener.Close()
+
+	// Anything else at the path is left alone
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(Options{UnixSocket: path}); err == nil {
+		t.Fatalf("listening replaced a regular file")
+	}
+}
+
+func TestUnixSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signaller.sock")
+	listener, err := listen(Options{UnixSocket: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, err := listen(Options{UnixSocket: path}); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("listening on a socket in use: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket in use was removed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMaxHops(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxHops: 3}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "hops": 2})
+	if message := b.readType("offer"); message["hops"] != 3.0 {
+		t.Fatalf("hops %v after relaying, want 3", message["hops"])
+	}
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "hops": 3})
+	a.readError("hop_limit_exceeded")
+	b.expectNone(100 * time.Millisecond)
+}
+
+func TestMetadataForwarded(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxMetadataBytes: 64}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	metadata := map[string]interface{}{"latencyHint": "low", "simulcast": true, "layers": []interface{}{1.0, 2.0}}
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP(testSDP), "metadata": metadata})
+	message := b.readType("offer")
+	if !reflect.DeepEqual(message["metadata"], metadata) {
+		t.Fatalf("metadata arrived as %v", message["metadata"])
+	}
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "metadata": []int{1}})
+	a.readError("invalid_metadata")
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "metadata": map[string]string{"x": strings.Repeat("x", 64)}})
+	a.readError("metadata_too_large")
+	b.expectNone(100 * time.Millisecond)
+}
+
+func TestRequireReady(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{RequireReady: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	if a.welcome["requireReady"] != true {
+		t.Fatalf("welcome does not ask for ready: %v", a.welcome)
+	}
+
+	candidate := map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c"}
+	a.send(candidate)
+	a.readError("not_ready")
+	b.expectNone(50 * time.Millisecond)
+
+	a.send(map[string]string{"signalType": "ready"})
+	a.send(candidate)
+	if message := b.readType("candidate"); message["candidate"] != "c" {
+		t.Fatalf("got %v once ready", message)
+	}
+}
+
+func TestDisconnectSignal(t *testing.T) {
+	ws := NewWebSocketServer(Options{})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+
+	b.send(map[string]string{"signalType": "disconnect"})
+	if message := a.readType("peer_left"); message["userId"] != b.id {
+		t.Fatalf("got %v, want %s to leave", message, b.id)
+	}
+	b.expectCloseCode(websocket.CloseNormalClosure)
+
+	for deadline := time.Now().Add(readTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if _, exists := ws.connectionManager.Get(b.id); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("disconnected client still registered")
+		}
+	}
+	if members := ws.roomManager.Members("r"); len(members) != 1 || members[0] != a.id {
+		t.Fatalf("room members %v after disconnecting", members)
+	}
+}
+
+func TestKeyExchangeForwarded(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MaxKeyExchangeBytes: 4096}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	payload := map[string]interface{}{"p": strings.Repeat("AbC+/=", 500), "g": 2.0, "curve": []interface{}{"x25519"}}
+	a.send(map[string]interface{}{"signalType": "key-exchange", "userId": b.id, "payload": payload})
+	message := b.readType("key-exchange")
+	if message["userId"] != a.id || !reflect.DeepEqual(message["payload"], payload) {
+		t.Fatalf("got %v", message)
+	}
+
+	a.send(map[string]interface{}{"signalType": "key-exchange", "userId": b.id, "payload": strings.Repeat("x", 4096)})
+	a.readError("key_exchange_too_large")
+	b.expectNone(50 * time.Millisecond)
+}
+
+func TestKeyExchangePayloadForwardedByteForByte(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	payload := `{ "p" : "<a&b>" }`
+	if err := a.conn.WriteMessage(websocket.TextMessage, []byte(`{"signalType":"key-exchange","userId":"`+b.id+`","payload":`+payload+`}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-b.messages:
+		if !strings.Contains(string(data), `"payload":`+payload) {
+			t.Fatalf("payload changed on the way: %s", data)
+		}
+	case <-time.After(readTimeout):
+		t.Fatalf("key exchange not forwarded")
+	}
+}
+
+func TestSameCandidateToSeveralTargets(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{Dedup: true, RateLimit: 0.01, RateBurst: 2}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	d := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{"signalType": "candidate", "userIds": []string{b.id, c.id, d.id, "gone"}, "candidate": "c"})
+	for _, target := range []*testClient{b, c, d} {
+		message := target.readType("candidate")
+		if message["userId"] != a.id || message["userIds"] != nil {
+			t.Fatalf("got %v", message)
+		}
+	}
+	if message := a.readError("target_not_found"); message["target"] != "gone" {
+		t.Fatalf("error names target %v", message["target"])
+	}
+
+	// Each target still deduplicates on its own
+	a.send(map[string]interface{}{"signalType": "candidate", "userIds": []string{b.id}, "candidate": "c"})
+	b.expectNone(50 * time.Millisecond)
+}
+
+func TestVerifyPayloadOrigin(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{VerifyPayloadOrigin: true}))
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), http.Header{"Origin": {"https://app.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := newTestClient(t, conn)
+	if welcome := a.readType("welcome"); welcome["origin"] != "https://app.example" {
+		t.Fatalf("welcome %v does not tell the client its origin", welcome)
+	}
+
+	for _, origin := range []string{"https://other.example", ""} {
+		a.send(map[string]string{"signalType": "listRooms", "origin": origin})
+		a.readError("origin_mismatch")
+	}
+	a.send(map[string]string{"signalType": "listRooms", "origin": "https://app.example"})
+	a.readType("rooms")
+}
+
+func TestFallbackDelivery(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	laptop := dial(t, srv, "/ws")
+	phone := dial(t, srv, "/ws")
+
+	// Offline targets are skipped until one is online
+	a.send(map[string]interface{}{"signalType": "candidate", "userId": "desktop", "fallbacks": []string{"tablet", laptop.id, phone.id}, "candidate": "c"})
+	if message := laptop.readType("candidate"); message["userId"] != a.id || message["fallbacks"] != nil {
+		t.Fatalf("got %v", message)
+	}
+	delivered := a.readType("delivered")
+	if delivered["to"] != laptop.id || delivered["fallback"] != true || delivered["signal"] != "candidate" {
+		t.Fatalf("delivered %v, want it confirmed for %s", delivered, laptop.id)
+	}
+	phone.expectNone(50 * time.Millisecond)
+
+	// An online primary gets it without trying the fallbacks
+	a.send(map[string]interface{}{"signalType": "candidate", "userId": phone.id, "fallbacks": []string{laptop.id}, "candidate": "c"})
+	phone.readType("candidate")
+	if delivered := a.readType("delivered"); delivered["to"] != phone.id || delivered["fallback"] != false {
+		t.Fatalf("delivered %v", delivered)
+	}
+	laptop.expectNone(50 * time.Millisecond)
+
+	a.send(map[string]interface{}{"signalType": "candidate", "userId": "desktop", "fallbacks": []string{"tablet"}, "candidate": "c"})
+	a.readError("target_not_found")
+}
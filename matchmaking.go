@@ -0,0 +1,131 @@
+package main
+
+import "sync"
+
+// MatchCriteria are what a client is looking for in a peer. Clients are
+// only paired when their region and topic are equal and, with a skill range
+// set, their skills are close enough.
+type MatchCriteria struct {
+	Region string `json:"region,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Skill  int    `json:"skill,omitempty"`
+}
+
+// key is the queue clients with these criteria wait in
+func (c MatchCriteria) key() string {
+	return c.Region + "\x00" + c.Topic
+}
+
+type matchTicket struct {
+	id       string
+	criteria MatchCriteria
+}
+
+// Matchmaker keeps clients waiting for a peer in queues indexed by their
+// criteria, oldest first
+type Matchmaker struct {
+	// skillRange is the largest skill difference between paired clients,
+	// zero ignores skill
+	skillRange int
+
+	queues map[string][]matchTicket
+	queued map[string]string
+	mutex  sync.Mutex
+}
+
+// NewMatchmaker creates a new Matchmaker
+func NewMatchmaker(skillRange int) *Matchmaker {
+	return &Matchmaker{
+		skillRange: skillRange,
+		queues:     make(map[string][]matchTicket),
+		queued:     make(map[string]string),
+	}
+}
+
+// Enqueue pairs a client with the longest waiting compatible client, taking
+// that one out of its queue, or queues the client if there is none. A client
+// that was already queued is requeued with its new criteria.
+func (m *Matchmaker) Enqueue(id string, criteria MatchCriteria) (peer string, matched bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.removeLocked(id)
+
+	key := criteria.key()
+	queue := m.queues[key]
+	for i, ticket := range queue {
+		if !m.compatible(ticket.criteria, criteria) {
+			continue
+		}
+		m.queues[key] = append(queue[:i], queue[i+1:]...)
+		if len(m.queues[key]) == 0 {
+			delete(m.queues, key)
+		}
+		delete(m.queued, ticket.id)
+		return ticket.id, true
+	}
+
+	m.queues[key] = append(queue, matchTicket{id: id, criteria: criteria})
+	m.queued[id] = key
+	return "", false
+}
+
+// Cancel takes a client out of its queue
+func (m *Matchmaker) Cancel(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.removeLocked(id)
+}
+
+// Rename replaces a queued client's ID, keeping its place in the queue
+func (m *Matchmaker) Rename(oldID string, newID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key, ok := m.queued[oldID]
+	if !ok {
+		return
+	}
+	delete(m.queued, oldID)
+	m.queued[newID] = key
+
+	for i, ticket := range m.queues[key] {
+		if ticket.id == oldID {
+			m.queues[key][i].id = newID
+			break
+		}
+	}
+}
+
+// compatible reports whether two clients in the same queue may be paired
+func (m *Matchmaker) compatible(a MatchCriteria, b MatchCriteria) bool {
+	if m.skillRange <= 0 {
+		return true
+	}
+	difference := a.Skill - b.Skill
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference <= m.skillRange
+}
+
+// removeLocked drops a client from its queue. Callers must hold the lock.
+func (m *Matchmaker) removeLocked(id string) bool {
+	key, ok := m.queued[id]
+	if !ok {
+		return false
+	}
+	delete(m.queued, id)
+
+	queue := m.queues[key]
+	for i, ticket := range queue {
+		if ticket.id == id {
+			m.queues[key] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(m.queues[key]) == 0 {
+		delete(m.queues, key)
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// matchmake queues the client with criteria
+func (c *testClient) matchmake(region, topic string, skill int) {
+	c.t.Helper()
+	criteria := map[string]interface{}{"region": region, "topic": topic, "skill": skill}
+	c.send(map[string]interface{}{"signalType": "matchmake", "criteria": criteria})
+}
+
+func TestMatchmakingPairsCompatibleClients(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MatchSkillRange: 10}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.matchmake("eu", "chess", 100)
+	a.readType("match_queued")
+	b.matchmake("eu", "chess", 105)
+
+	matchB := b.readType("match_found")
+	matchA := a.readType("match_found")
+	if matchB["peerId"] != a.id || matchA["peerId"] != b.id {
+		t.Fatalf("matched %v and %v", matchA, matchB)
+	}
+	if matchA["room"] == nil || matchA["room"] != matchB["room"] {
+		t.Fatalf("matched into rooms %v and %v", matchA["room"], matchB["room"])
+	}
+}
+
+func TestMatchmakingKeepsIncompatibleClientsWaiting(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MatchSkillRange: 10}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	d := dial(t, srv, "/ws")
+
+	a.matchmake("eu", "chess", 100)
+	a.readType("match_queued")
+	for _, test := range []struct {
+		client *testClient
+		region string
+		topic  string
+		skill  int
+	}{
+		{b, "us", "chess", 100},
+		{c, "eu", "go", 100},
+		{d, "eu", "chess", 150},
+	} {
+		test.client.matchmake(test.region, test.topic, test.skill)
+		test.client.readType("match_queued")
+	}
+	a.expectNone(100 * time.Millisecond)
+
+	// Requeuing with closer skill finds the client still waiting
+	d.matchmake("eu", "chess", 95)
+	if message := d.readType("match_found"); message["peerId"] != a.id {
+		t.Fatalf("matched %v", message)
+	}
+	b.expectNone(50 * time.Millisecond)
+	c.expectNone(50 * time.Millisecond)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// membershipDebouncer delays peer_joined/peer_left notifications so that a
+// member flapping in and out of a room within the window produces only its
+// final state. A pending change is cancelled by the opposite change for the
+// same member, which leaves the other peers' view of the room unchanged.
+type membershipDebouncer struct {
+	window  time.Duration
+	emit    func(room string, signalType string, id string)
+	pending map[membershipKey]*pendingChange
+	mutex   sync.Mutex
+}
+
+type membershipKey struct {
+	room string
+	id   string
+}
+
+type pendingChange struct {
+	signalType string
+	timer      *time.Timer
+}
+
+// newMembershipDebouncer creates a debouncer that calls emit once a change
+// has been stable for window
+func newMembershipDebouncer(window time.Duration, emit func(room string, signalType string, id string)) *membershipDebouncer {
+	return &membershipDebouncer{
+		window:  window,
+		emit:    emit,
+		pending: make(map[membershipKey]*pendingChange),
+	}
+}
+
+// Notify records a membership change for a member of room
+func (d *membershipDebouncer) Notify(room string, signalType string, id string) {
+	key := membershipKey{room, id}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if change, ok := d.pending[key]; ok {
+		change.timer.Stop()
+		delete(d.pending, key)
+		if change.signalType != signalType {
+			return
+		}
+	}
+
+	change := &pendingChange{signalType: signalType}
+	change.timer = time.AfterFunc(d.window, func() {
+		d.mutex.Lock()
+		current := d.pending[key]
+		if current == change {
+			delete(d.pending, key)
+		}
+		d.mutex.Unlock()
+
+		// Lost a race with a cancelling change
+		if current != change {
+			return
+		}
+		d.emit(room, signalType, id)
+	})
+	d.pending[key] = change
+}
+
+// membershipBatcher collects a room's membership changes for an interval
+// and emits them together, so that a burst of joins, such as a class
+// starting, costs each member one message instead of one per join. A member
+// that joins and leaves within the interval cancels out.
+type membershipBatcher struct {
+	interval time.Duration
+	emit     func(room string, added []string, removed []string)
+	pending  map[string]*membershipBatch
+	mutex    sync.Mutex
+}
+
+type membershipBatch struct {
+	added   []string
+	removed []string
+}
+
+// newMembershipBatcher creates a batcher that calls emit with a room's
+// changes interval after the first of them
+func newMembershipBatcher(interval time.Duration, emit func(room string, added []string, removed []string)) *membershipBatcher {
+	return &membershipBatcher{
+		interval: interval,
+		emit:     emit,
+		pending:  make(map[string]*membershipBatch),
+	}
+}
+
+// Add records a membership change for a member of room
+func (b *membershipBatcher) Add(room string, signalType string, id string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	batch, ok := b.pending[room]
+	if !ok {
+		batch = &membershipBatch{}
+		b.pending[room] = batch
+		time.AfterFunc(b.interval, func() {
+			b.mutex.Lock()
+			delete(b.pending, room)
+			b.mutex.Unlock()
+
+			if len(batch.added) > 0 || len(batch.removed) > 0 {
+				b.emit(room, batch.added, batch.removed)
+			}
+		})
+	}
+
+	if signalType == "peer_joined" {
+		if !removeID(&batch.removed, id) {
+			batch.added = append(batch.added, id)
+		}
+	} else if !removeID(&batch.added, id) {
+		batch.removed = append(batch.removed, id)
+	}
+}
+
+// removeID removes id from ids and reports whether it was there
+func removeID(ids *[]string, id string) bool {
+	for i, other := range *ids {
+		if other == id {
+			*ids = append((*ids)[:i], (*ids)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMembershipDebounceCoalescesFlaps(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MembershipDebounce: 100 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.join("r")
+
+	for i := 0; i < 3; i++ {
+		b.join("r")
+		b.send(map[string]string{"signalType": "leave"})
+	}
+	b.join("r")
+
+	message := a.read()
+	if message["signalType"] != "peer_joined" || message["userId"] != b.id {
+		t.Fatalf("got %v, want a single peer_joined for %s", message, b.id)
+	}
+	a.expectNone(200 * time.Millisecond)
+}
+
+func TestMembershipDebounceCancelsOut(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MembershipDebounce: 100 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.join("r")
+
+	b.join("r")
+	b.send(map[string]string{"signalType": "leave"})
+	a.expectNone(200 * time.Millisecond)
+}
+
+// joinWithDeltas puts the client in a room asking for roster deltas
+func (c *testClient) joinWithDeltas(room string) map[string]interface{} {
+	c.t.Helper()
+	c.send(map[string]interface{}{"signalType": "join", "room": room, "deltas": true})
+	return c.readType("joined")
+}
+
+func TestPeerListDeltas(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	a.joinWithDeltas("r")
+	b.join("r")
+
+	delta := a.readType("peer_list_changed")
+	if added, _ := delta["added"].([]interface{}); len(added) != 1 || added[0] != b.id || delta["members"] != nil {
+		t.Fatalf("got %v, want %s added", delta, b.id)
+	}
+
+	// Members that did not ask for deltas still get the full roster
+	c.join("r")
+	a.readType("peer_list_changed")
+	if members := members(b.readType("peer_joined")); len(members) != 3 {
+		t.Fatalf("roster %v, want all three members", members)
+	}
+
+	c.send(map[string]string{"signalType": "leave"})
+	if removed, _ := a.readType("peer_list_changed")["removed"].([]interface{}); len(removed) != 1 || removed[0] != c.id {
+		t.Fatalf("removed %v, want %s", removed, c.id)
+	}
+	b.readType("peer_left")
+}
+
+func TestFailedJoinKeepsDeltas(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.joinWithDeltas("r")
+	locked := b.createRoom(map[string]interface{}{"password": "secret"})
+
+	a.send(map[string]interface{}{"signalType": "join", "room": locked, "password": "wrong"})
+	a.readError("wrong_password")
+	a.send(map[string]interface{}{"signalType": "join", "room": "r", "role": "admin"})
+	a.readError("invalid_role")
+
+	b.join("r")
+	a.readType("peer_list_changed")
+}
+
+func TestMembershipBatchesJoinBursts(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{MembershipBatch: 300 * time.Millisecond}))
+	host := dial(t, srv, "/ws")
+	host.join("class")
+	var students []*testClient
+	for i := 0; i < 10; i++ {
+		students = append(students, dial(t, srv, "/ws"))
+	}
+
+	joinAll("class", students...)
+	students[9].send(map[string]string{"signalType": "leave"})
+
+	// One batch for the whole burst, in which the join and leave of the
+	// last student cancel out
+	batch := host.read()
+	added, _ := batch["added"].([]interface{})
+	removed, _ := batch["removed"].([]interface{})
+	if batch["signalType"] != "peers_changed" || len(added) != 9 || len(removed) != 0 || len(members(batch)) != 10 {
+		t.Fatalf("got %v, want one batch adding 9 students", batch)
+	}
+	host.expectNone(400 * time.Millisecond)
+
+	students[0].send(map[string]string{"signalType": "leave"})
+	batch = host.readType("peers_changed")
+	if removed, _ := batch["removed"].([]interface{}); len(removed) != 1 || removed[0] != students[0].id {
+		t.Fatalf("got %v, want %s removed", batch, students[0].id)
+	}
+}
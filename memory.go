@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+// Memory pressure levels. Under soft pressure signals are no longer held for
+// paused clients and whatever is held or batched is let go; under hard
+// pressure new connections are refused as well.
+const (
+	memoryPressureNone int32 = iota
+	memoryPressureSoft
+	memoryPressureHard
+)
+
+// heapInUse reports the bytes of heap the server is using
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// memoryMonitor periodically checks memory use against the configured
+// limits and sheds queued signals once it goes over the soft limit
+func (ws *WebSocketServer) memoryMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			ws.checkMemory()
+		}
+	}
+}
+
+// checkMemory updates the memory pressure level, shedding queued signals
+// when it is raised
+func (ws *WebSocketServer) checkMemory() {
+	used := ws.memoryUsage()
+
+	level := memoryPressureNone
+	switch {
+	case ws.opts.MemoryHardLimit > 0 && used >= uint64(ws.opts.MemoryHardLimit):
+		level = memoryPressureHard
+	case ws.opts.MemorySoftLimit > 0 && used >= uint64(ws.opts.MemorySoftLimit):
+		level = memoryPressureSoft
+	}
+
+	previous := ws.memoryPressure.Swap(level)
+	if level == previous {
+		return
+	}
+	log.Printf("Memory pressure changed from %d to %d (%d bytes in use)\n", previous, level, used)
+	if level > memoryPressureNone {
+		ws.shedQueues()
+	}
+}
+
+// shedQueueDepth is how many messages a send queue or poll mailbox keeps
+// when memory pressure sheds the rest
+const shedQueueDepth = 16
+
+// shedQueues drops the signals held for paused clients, the oldest messages
+// of long send queues and poll mailboxes, and the SSE history kept for
+// reconnecting streams, and sends out pending candidate batches
+func (ws *WebSocketServer) shedQueues() {
+	dropped := 0
+	for _, client := range ws.connectionManager.All() {
+		dropped += client.DropHeld()
+		if client.batch != nil {
+			client.batch.Flush()
+		}
+		dropped += client.TrimQueue(shedQueueDepth)
+	}
+	for _, session := range ws.pollSessions.all() {
+		dropped += session.sender.trim(shedQueueDepth)
+		session.stream.dropHistory()
+	}
+	if dropped > 0 {
+		ws.metrics.messagesDropped.Add(int64(dropped))
+		log.Printf("Dropped %d queued signals to relieve memory pressure 🔥\n", dropped)
+	}
+}
+
+// holdLimit is how many signals may be held for a paused client, which is
+// none while under memory pressure
+func (ws *WebSocketServer) holdLimit() int {
+	if ws.memoryPressure.Load() > memoryPressureNone {
+		return 0
+	}
+	return ws.opts.PauseQueueSize
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryPressureTrimsQueuesBeforeRefusingConnections(t *testing.T) {
+	// The monitor never ticks; the test checks memory itself
+	ws := NewWebSocketServer(Options{MemorySoftLimit: 100, MemoryHardLimit: 200, QueueSampleInterval: time.Hour})
+	var used atomic.Uint64
+	ws.memoryUsage = used.Load
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	b.send(map[string]string{"signalType": "pause"})
+	b.readType("paused")
+	for _, candidate := range []string{"1", "2"} {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+	}
+	a.touch()
+
+	// Soft pressure lets go of the held signals but still admits connections
+	used.Store(150)
+	ws.checkMemory()
+	b.send(map[string]string{"signalType": "resume"})
+	if message := b.readType("resumed"); message["delivered"] != 0.0 {
+		t.Fatalf("resumed %v under memory pressure, want the held signals dropped", message)
+	}
+	dial(t, srv, "/ws")
+
+	// Hard pressure refuses them
+	used.Store(250)
+	ws.checkMemory()
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection under hard memory pressure: %v", resp)
+	}
+
+	used.Store(50)
+	ws.checkMemory()
+	dial(t, srv, "/ws")
+}
+
+func TestSheddingReleasesQueuedMemory(t *testing.T) {
+	ws := NewWebSocketServer(Options{QueueSampleInterval: time.Hour})
+	defer ws.Stop()
+
+	// A client that stopped reading, and a long-polling session with an
+	// SSE history that nobody is collecting
+	sender := newStalledSender()
+	stalled := NewClient("stalled", sender, 256)
+	defer sender.Close()
+	ws.connectionManager.Add(stalled.ID(), stalled)
+	session := &pollSession{sender: newPollSender()}
+	session.client = NewClient("polling", session.sender, 256)
+	defer session.client.Close()
+	ws.pollSessions.add("session", session)
+
+	const messageBytes = 64 * 1024
+	for i := 0; i < 128; i++ {
+		stalled.WriteMessage(make([]byte, messageBytes))
+	}
+	_, wake, _ := session.stream.take(context.Background(), "")
+	for i := 0; i < pollMailboxSize; i++ {
+		session.sender.mailbox <- make([]byte, messageBytes)
+		session.stream.record(make([]byte, messageBytes))
+	}
+	session.stream.unsent(wake)
+
+	runtime.GC()
+	before := heapInUse()
+	ws.shedQueues()
+	runtime.GC()
+	after := heapInUse()
+
+	if stalled.QueueDepth() > shedQueueDepth || len(session.sender.mailbox) > shedQueueDepth || len(session.stream.history) > 0 {
+		t.Fatalf("queues not trimmed: send queue %d, mailbox %d", stalled.QueueDepth(), len(session.sender.mailbox))
+	}
+	// Most of the 16 MB queued is let go
+	if freed := int64(before) - int64(after); freed < 12<<20 {
+		t.Fatalf("shedding freed %d bytes (%d in use before, %d after)", freed, before, after)
+	}
+}
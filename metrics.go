@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds the server's counters
+type Metrics struct {
+	messagesForwarded atomic.Int64
+	messagesDropped   atomic.Int64
+	messagesShed      atomic.Int64
+
+	// Messages refused by a rate limit, and connections refused or evicted
+	// by the connection limit
+	messagesRateLimited atomic.Int64
+	connectionsRejected atomic.Int64
+	connectionsEvicted  atomic.Int64
+
+	// protocolErrors counts the connections closed for breaking the
+	// WebSocket protocol, by kind
+	protocolErrors protocolErrors
+
+	// Time spent checking and munging SDP, and how many offers and answers
+	// were checked or skipped for being too large
+	sdpValidationNanos    atomic.Int64
+	sdpValidations        atomic.Int64
+	sdpValidationsSkipped atomic.Int64
+}
+
+// handleMetrics exposes the server's metrics in the Prometheus text format
+func (ws *WebSocketServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	clients := ws.connectionManager.All()
+
+	queued, slow := 0, 0
+	for _, client := range clients {
+		queued += client.QueueDepth()
+		if client.Slow() {
+			slow++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "signaller_connections", "gauge", "Open connections.", len(clients))
+	writeMetric(w, "signaller_slow_connections", "gauge", "Connections flagged as slow to drain their send queue.", slow)
+	writeMetric(w, "signaller_queued_messages", "gauge", "Messages waiting in send queues.", queued)
+	writeMetric(w, "signaller_messages_forwarded_total", "counter", "Messages forwarded to a connection.", ws.metrics.messagesForwarded.Load())
+	writeMetric(w, "signaller_messages_dropped_total", "counter", "Messages dropped because the target's send or pause queue was full, or to relieve memory pressure.", ws.metrics.messagesDropped.Load())
+	writeMetric(w, "signaller_messages_shed_total", "counter", "Low priority signals dropped while the server was overloaded.", ws.metrics.messagesShed.Load())
+	writeMetric(w, "signaller_messages_rate_limited_total", "counter", "Messages refused by the per-connection or server wide rate limit.", ws.metrics.messagesRateLimited.Load())
+	writeMetric(w, "signaller_connections_rejected_total", "counter", "Connections refused for exceeding the connection limit.", ws.metrics.connectionsRejected.Load())
+	writeMetric(w, "signaller_connections_evicted_total", "counter", "Least recently active connections closed to admit new ones at the connection limit.", ws.metrics.connectionsEvicted.Load())
+	writeProtocolErrors(w, ws.metrics.protocolErrors)
+	writeMetric(w, "signaller_sdp_validation_seconds_total", "counter", "Time spent validating and munging SDP.", time.Duration(ws.metrics.sdpValidationNanos.Load()).Seconds())
+	writeMetric(w, "signaller_sdp_validations_total", "counter", "Offers and answers whose SDP was validated.", ws.metrics.sdpValidations.Load())
+	writeMetric(w, "signaller_sdp_validations_skipped_total", "counter", "Offers and answers forwarded unvalidated for exceeding the validation size cap.", ws.metrics.sdpValidationsSkipped.Load())
+	writeMetric(w, "signaller_memory_pressure", "gauge", "Memory pressure level: 0 none, 1 shedding queued signals, 2 also refusing connections.", ws.memoryPressure.Load())
+	writeMetric(w, "signaller_load", "gauge", "Mean send queue depth across connections, as used for load shedding.", ws.Load())
+}
+
+// writeProtocolErrors writes the protocol error counts, labelled by kind
+func writeProtocolErrors(w http.ResponseWriter, counts protocolErrors) {
+	const name = "signaller_protocol_errors_total"
+	fmt.Fprintf(w, "# HELP %s Connections closed for WebSocket protocol errors, by kind.\n# TYPE %s counter\n", name, name)
+	for _, kind := range protocolErrorKinds {
+		fmt.Fprintf(w, "%s{kind=%q} %d\n", name, kind, counts[kind].Load())
+	}
+}
+
+// writeMetric writes a single unlabelled metric with its metadata
+func writeMetric(w http.ResponseWriter, name string, kind string, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// nonceBytes is the number of random bytes in a nonce
+const nonceBytes = 16
+
+// newNonce returns a random, URL safe nonce
+func newNonce() string {
+	nonce := make([]byte, nonceBytes)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// stampNonce adds a fresh "nonce" and its "issuedAt" time, in Unix
+// milliseconds, to an encoded signal. Receivers that remember the nonces
+// they saw recently, and drop signals issued too long ago, can reject
+// signals replayed to them from elsewhere. Forwarded signals are always
+// re-encoded from known fields, so a sender cannot supply its own nonce.
+func stampNonce(data []byte) []byte {
+	end := bytes.LastIndexByte(data, '}')
+	if end < 0 {
+		return data
+	}
+
+	stamped := make([]byte, 0, len(data)+64)
+	stamped = append(stamped, data[:end]...)
+	stamped = append(stamped, `,"nonce":"`...)
+	stamped = append(stamped, newNonce()...)
+	stamped = append(stamped, `","issuedAt":`...)
+	stamped = strconv.AppendInt(stamped, time.Now().UnixMilli(), 10)
+	stamped = append(stamped, data[end:]...)
+	return stamped
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwardsCarryUniqueNonces(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{StampNonces: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+
+	// Resending the same signal still gets a new nonce, and senders cannot
+	// pick their own
+	seen := make(map[interface{}]bool)
+	for i := 0; i < 3; i++ {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c", "nonce": "chosen"})
+		message := b.readType("candidate")
+		nonce := message["nonce"]
+		if nonce == nil || nonce == "chosen" || seen[nonce] {
+			t.Fatalf("forward %d has nonce %v", i, nonce)
+		}
+		seen[nonce] = true
+
+		issuedAt, _ := message["issuedAt"].(float64)
+		if age := time.Since(time.UnixMilli(int64(issuedAt))); age < 0 || age > time.Minute {
+			t.Fatalf("forward issued at %v", message["issuedAt"])
+		}
+	}
+
+	// Every recipient of a broadcast gets a nonce of its own
+	joinAll("r", a, b, c)
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": "hello"})
+	toB, toC := b.readType("broadcast")["nonce"], c.readType("broadcast")["nonce"]
+	if toB == nil || toB == toC {
+		t.Fatalf("broadcast nonces %v and %v", toB, toC)
+	}
+}
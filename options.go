@@ -0,0 +1,418 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configures the signaling server. Fields holding secrets are
+// tagged redact:"true" so that /admin/config never exposes them.
+type Options struct {
+	// Addr is the TCP address the HTTP server listens on
+	Addr string `json:"addr"`
+
+	// UnixSocket is a Unix domain socket path to listen on instead of
+	// Addr, for running behind a local reverse proxy
+	UnixSocket string `json:"unixSocket"`
+
+	// LivenessInterval is how often every room is sent the list of its
+	// currently connected members. Zero disables liveness broadcasts.
+	LivenessInterval time.Duration `json:"livenessInterval"`
+
+	// IdentitySecret is the HMAC key identity tokens are signed with.
+	// When empty, "upgrade-identity" requests are rejected.
+	IdentitySecret string `json:"identitySecret" redact:"true"`
+
+	// AdminToken is the bearer token required by the /admin endpoints.
+	// When empty, the admin endpoints are disabled.
+	AdminToken string `json:"adminToken" redact:"true"`
+
+	// Dedup drops forwarded messages identical to one of the last
+	// DedupWindow messages already delivered to the same connection.
+	// Larger windows catch repeats further apart at the cost of memory per
+	// connection.
+	Dedup       bool `json:"dedup"`
+	DedupWindow int  `json:"dedupWindow"`
+	// DedupPerGeneration lets a client send "sdp-reset" when it
+	// renegotiates, after which its signals are no longer matched against
+	// ones from the earlier negotiation.
+	DedupPerGeneration bool `json:"dedupPerGeneration"`
+
+	// ReplayWindow, when set, rejects with "replay_detected" any message
+	// whose messageId its sender already used within the window. Messages
+	// without a messageId are not checked.
+	ReplayWindow time.Duration `json:"replayWindow"`
+
+	// ReplayLog is a file every forwarded message is appended to, with
+	// credentials stripped, so a session can be replayed when debugging.
+	// ReplayBuffer bounds how many entries may be waiting to be written.
+	ReplayLog    string `json:"replayLog"`
+	ReplayBuffer int    `json:"replayBuffer"`
+
+	// ReplaySink receives forwarded messages when set. main opens a
+	// FileReplaySink for ReplayLog; embedders may supply their own.
+	ReplaySink ReplaySink `json:"-"`
+
+	// MembershipDebounce delays peer_joined/peer_left notifications so
+	// that a member leaving and rejoining within the window is not
+	// announced at all. Zero sends notifications immediately.
+	MembershipDebounce time.Duration `json:"membershipDebounce"`
+
+	// MembershipBatch, when set, sends each room's membership changes
+	// together every interval, as "peers_changed" (or "peer_list_changed"
+	// for members using deltas), instead of one event per join or leave.
+	// Changes are debounced first if MembershipDebounce is also set.
+	MembershipBatch time.Duration `json:"membershipBatch"`
+
+	// InstanceID identifies this server in multi-instance deployments. It
+	// is included in the welcome message and, with StampInstanceID, in
+	// every forwarded signal.
+	InstanceID      string `json:"instanceId"`
+	StampInstanceID bool   `json:"stampInstanceId"`
+
+	// StampNonces adds a server generated nonce and issue time to every
+	// forwarded signal, which receivers can track to reject replays
+	StampNonces bool `json:"stampNonces"`
+
+	// OrderedRooms gives everything sent within a room, broadcasts,
+	// membership events and signals between members alike, a room-wide
+	// "seq" and delivers it one message at a time, so that all members see
+	// the room's events in the same order. This costs latency: a delivery
+	// waits for the one before it to be queued for every member, so one
+	// busy room no longer spreads over several goroutines. Signals held for
+	// a paused member arrive after the room events sent meanwhile; sort by
+	// seq to restore the order.
+	OrderedRooms bool `json:"orderedRooms"`
+
+	// NotifyCallState tells the rest of a room, with "call_state_changed",
+	// whenever one member sends another a "call-state"
+	NotifyCallState bool `json:"notifyCallState"`
+
+	// RateLimit caps how many messages per second each connection may
+	// send, allowing bursts of up to RateBurst. Both are advertised in the
+	// welcome message. Zero disables rate limiting.
+	RateLimit float64 `json:"rateLimit"`
+	RateBurst int     `json:"rateBurst"`
+
+	// ServerRateLimit caps the messages per second of all connections
+	// together, with bursts of up to ServerRateBurst, and MaxConnections,
+	// when non-zero, the number of open connections. With -tenants each
+	// tenant has limits of its own.
+	ServerRateLimit float64 `json:"serverRateLimit"`
+	ServerRateBurst int     `json:"serverRateBurst"`
+	MaxConnections  int     `json:"maxConnections"`
+
+	// EvictionPolicy decides what happens to new connections at
+	// MaxConnections: EvictionReject refuses them, EvictionLRU closes the
+	// least recently active connection, with close code 1013, to let them
+	// in
+	EvictionPolicy string `json:"evictionPolicy"`
+
+	// MaxHops drops signals that have already been relayed this many times,
+	// protecting bridged or chained servers from relay loops. Zero allows
+	// any number of hops.
+	MaxHops int `json:"maxHops"`
+
+	// MaxTargets caps how many peers one signal may list in userIds
+	MaxTargets int `json:"maxTargets"`
+
+	// RequireDTLS rejects offers and answers whose SDP has no DTLS
+	// fingerprint or asks for a non-DTLS media transport
+	RequireDTLS bool `json:"requireDtls"`
+
+	// SendQueueSize is how many outgoing messages may wait for a client
+	// before further messages to it are dropped
+	SendQueueSize int `json:"sendQueueSize"`
+
+	// SlowClientThreshold flags a client as slow once the moving average
+	// of its send queue depth, sampled every QueueSampleInterval, reaches
+	// it. Zero disables slow client detection.
+	SlowClientThreshold float64       `json:"slowClientThreshold"`
+	QueueSampleInterval time.Duration `json:"queueSampleInterval"`
+
+	// DefaultRoom is a room every connection is placed in on connect, so
+	// that single-room apps get broadcasts and rosters without an explicit
+	// join. Empty means connections start outside any room.
+	DefaultRoom string `json:"defaultRoom"`
+
+	// SDPStripCodecs lists codecs removed from every forwarded offer and
+	// answer, and SDPBandwidth, when non-zero, forces a b=AS bandwidth
+	// line (in kbps) on every audio and video section
+	SDPStripCodecs []string `json:"sdpStripCodecs"`
+	SDPBandwidth   int      `json:"sdpBandwidth"`
+
+	// SDPValidationMaxBytes, when non-zero, caps the cost of RequireDTLS
+	// and SDP munging: larger SDP (as base64) is forwarded without being
+	// decoded, so it is neither checked nor munged
+	SDPValidationMaxBytes int `json:"sdpValidationMaxBytes"`
+
+	// SDPCapabilities removes the codecs a target did not list in its
+	// "capabilities" from the offers and answers forwarded to it, within
+	// SDPValidationMaxBytes
+	SDPCapabilities bool `json:"sdpCapabilities"`
+
+	// RoomMaxLifetime closes rooms this long after they were created,
+	// whether or not they are in use, e.g. for time-boxed meetings. Zero
+	// lets rooms live until they empty out.
+	RoomMaxLifetime time.Duration `json:"roomMaxLifetime"`
+
+	// RoomSoloTimeout closes rooms that have had a single member for this
+	// long, telling the member with "room_closed"; zero keeps them open
+	RoomSoloTimeout time.Duration `json:"roomSoloTimeout"`
+
+	// StarRooms are the rooms given a StarPolicy, where members only
+	// signal the host, their longest standing member
+	StarRooms []string `json:"starRooms"`
+
+	// MaxMetadataBytes caps the encoded size of the metadata object a
+	// signal may carry
+	MaxMetadataBytes int `json:"maxMetadataBytes"`
+
+	// MaxKeyExchangeBytes caps the encoded size of a "key-exchange"
+	// payload
+	MaxKeyExchangeBytes int `json:"maxKeyExchangeBytes"`
+
+	// MaxMessageBytes caps the size of a message from a client; WebSocket
+	// connections sending a larger one are closed with 1009
+	MaxMessageBytes int64 `json:"maxMessageBytes"`
+
+	// OTLPEndpoint is an OpenTelemetry collector URL that traces of the
+	// connect, receive, forward and disconnect paths are exported to.
+	// TracerProvider is what main builds from it; embedders may supply
+	// their own. With neither, the global provider is used.
+	OTLPEndpoint   string               `json:"otlpEndpoint"`
+	TracerProvider trace.TracerProvider `json:"-"`
+
+	// PauseQueueSize is how many forwarded signals are held for a client
+	// that sent "pause" before further ones are dropped
+	PauseQueueSize int `json:"pauseQueueSize"`
+
+	// MaxFrameRate caps the WebSocket frames per second, continuation and
+	// control frames included, a connection may send before it is closed;
+	// zero disables
+	MaxFrameRate int `json:"maxFrameRate"`
+
+	// AllowedOrigins, when set, are the only browser origins (such as
+	// https://app.example.com) allowed to open a WebSocket
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// VerifyPayloadOrigin, for high-security deployments, rejects every
+	// message that does not repeat its connection's origin, as given in the
+	// welcome, in an "origin" field. This catches messages leaking in from
+	// another origin or tenant through a bug elsewhere.
+	VerifyPayloadOrigin bool `json:"verifyPayloadOrigin"`
+
+	// Tenants is a JSON file of tenants served over TLS, each under its own
+	// hostname with its own certificate, settings and namespace
+	Tenants string `json:"tenants"`
+
+	// AcceptHook lets embedders authenticate and name connections before
+	// they are upgraded; nil accepts everything with a generated ID
+	AcceptHook AcceptHook `json:"-"`
+
+	// AcceptWebhook, when AcceptHook is nil, is a URL every WebSocket
+	// request is described to, as an AcceptRequest POSTed to it, before it
+	// is upgraded. The webhook answers with an AcceptDecision within
+	// AcceptWebhookTimeout.
+	AcceptWebhook        string        `json:"acceptWebhook"`
+	AcceptWebhookTimeout time.Duration `json:"acceptWebhookTimeout"`
+
+	// LongPoll serves a long-polling transport on /poll for clients whose
+	// network blocks WebSockets. A GET waits up to LongPollTimeout for
+	// messages.
+	LongPoll        bool          `json:"longPoll"`
+	LongPollTimeout time.Duration `json:"longPollTimeout"`
+
+	// SSE serves a Server-Sent Events transport on /events, receiving over
+	// an event stream and sending with POST. Streams send a heartbeat every
+	// LongPollTimeout.
+	SSE bool `json:"sse"`
+
+	// ResumeGrace, when set, gives every client a resume token with which
+	// it can reconnect within this long after dropping and get its ID,
+	// room and role back. With ResumeMetadata its metadata, tags and
+	// aliases are restored too. The token also moves a connection that is
+	// still open to another transport, e.g. from long-polling to WebSocket.
+	ResumeGrace    time.Duration `json:"resumeGrace"`
+	ResumeMetadata bool          `json:"resumeMetadata"`
+
+	// CandidateBatchWindow, when set, holds candidates forwarded to a
+	// connection for this long after the first one and sends them together
+	// as one "candidates" message of at most CandidateBatchSize, which
+	// saves slow clients the per-message overhead
+	CandidateBatchWindow time.Duration `json:"candidateBatchWindow"`
+	CandidateBatchSize   int           `json:"candidateBatchSize"`
+
+	// RequireReady holds off forwarding a client's signals until it has
+	// acknowledged the welcome with "ready"
+	RequireReady bool `json:"requireReady"`
+
+	// MatchSkillRange is the largest skill difference between clients
+	// paired by "matchmake"; zero pairs regardless of skill
+	MatchSkillRange int `json:"matchSkillRange"`
+
+	// LoadShedThreshold is the load, the mean send queue depth, at which
+	// low priority signals like "presence" and "typing" are dropped; zero
+	// disables shedding
+	LoadShedThreshold float64 `json:"loadShedThreshold"`
+
+	// MemorySoftLimit is the heap size, in bytes, above which signals held
+	// for paused or batched connections are let go, and MemoryHardLimit the
+	// one above which new connections are refused too. Zero disables either.
+	MemorySoftLimit int64 `json:"memorySoftLimit"`
+	MemoryHardLimit int64 `json:"memoryHardLimit"`
+}
+
+// Defaults for the options that need a non-zero value to work
+const (
+	defaultDedupWindow         = 64
+	defaultRateBurst           = 20
+	defaultServerRateBurst     = 200
+	defaultSendQueueSize       = 256
+	defaultQueueSampleInterval = time.Second
+	defaultMaxMetadataBytes    = 1024
+	defaultMaxKeyExchangeBytes = 16 * 1024
+	defaultMaxMessageBytes     = 1 << 20
+	defaultPauseQueueSize      = 64
+	defaultCandidateBatchSize  = 16
+	defaultMaxTargets          = 16
+	defaultLongPollTimeout     = 25 * time.Second
+	defaultWebhookTimeout      = 5 * time.Second
+)
+
+// withDefaults fills in required options left at their zero value, so that
+// embedders only need to set what they care about
+func (o Options) withDefaults() Options {
+	if o.DedupWindow <= 0 {
+		o.DedupWindow = defaultDedupWindow
+	}
+	if o.RateBurst <= 0 {
+		o.RateBurst = defaultRateBurst
+	}
+	if o.ServerRateBurst <= 0 {
+		o.ServerRateBurst = defaultServerRateBurst
+	}
+	if o.EvictionPolicy == "" {
+		o.EvictionPolicy = EvictionReject
+	}
+	if o.SendQueueSize <= 0 {
+		o.SendQueueSize = defaultSendQueueSize
+	}
+	if o.QueueSampleInterval <= 0 {
+		o.QueueSampleInterval = defaultQueueSampleInterval
+	}
+	if o.MaxMetadataBytes <= 0 {
+		o.MaxMetadataBytes = defaultMaxMetadataBytes
+	}
+	if o.MaxKeyExchangeBytes <= 0 {
+		o.MaxKeyExchangeBytes = defaultMaxKeyExchangeBytes
+	}
+	if o.MaxMessageBytes <= 0 {
+		o.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	if o.CandidateBatchSize <= 0 {
+		o.CandidateBatchSize = defaultCandidateBatchSize
+	}
+	if o.MaxTargets <= 0 {
+		o.MaxTargets = defaultMaxTargets
+	}
+	if o.LongPollTimeout <= 0 {
+		o.LongPollTimeout = defaultLongPollTimeout
+	}
+	if o.PauseQueueSize <= 0 {
+		o.PauseQueueSize = defaultPauseQueueSize
+	}
+	if o.AcceptWebhookTimeout <= 0 {
+		o.AcceptWebhookTimeout = defaultWebhookTimeout
+	}
+	return o
+}
+
+// parseOptions reads Options from the command line flags
+func parseOptions() Options {
+	var opts Options
+
+	hostname, _ := os.Hostname()
+
+	flag.StringVar(&opts.Addr, "addr", ":8080", "address to listen on")
+	flag.StringVar(&opts.UnixSocket, "unix-socket", "", "Unix domain socket path to listen on instead of -addr")
+	flag.DurationVar(&opts.LivenessInterval, "liveness-interval", 0, "interval between room liveness broadcasts (0 disables)")
+	flag.StringVar(&opts.IdentitySecret, "identity-secret", "", "HMAC key for verifying identity tokens")
+	flag.StringVar(&opts.AdminToken, "admin-token", "", "bearer token for the admin endpoints (empty disables them)")
+	flag.BoolVar(&opts.Dedup, "dedup", false, "drop repeated messages forwarded to the same connection")
+	flag.IntVar(&opts.DedupWindow, "dedup-window", defaultDedupWindow, "number of recent messages per connection checked for duplicates")
+	flag.BoolVar(&opts.DedupPerGeneration, "dedup-per-generation", false, "only drop repeats sent within the same negotiation, as delimited by sdp-reset")
+	flag.DurationVar(&opts.ReplayWindow, "replay-window", 0, "time within which a sender may not reuse a messageId (0 disables)")
+	flag.StringVar(&opts.ReplayLog, "replay-log", "", "file to record forwarded messages to for replay (empty disables)")
+	flag.IntVar(&opts.ReplayBuffer, "replay-buffer", 1024, "maximum number of replay entries waiting to be written")
+	flag.DurationVar(&opts.MembershipDebounce, "membership-debounce", 0, "window for coalescing rapid join/leave notifications (0 disables)")
+	flag.DurationVar(&opts.MembershipBatch, "membership-batch", 0, "interval at which each room's membership changes are sent as one batch (0 disables)")
+	flag.StringVar(&opts.InstanceID, "instance-id", hostname, "ID of this server instance reported to clients")
+	flag.BoolVar(&opts.StampInstanceID, "stamp-instance-id", false, "include the instance ID in forwarded signals")
+	flag.BoolVar(&opts.StampNonces, "stamp-nonces", false, "include a unique nonce and its issue time in every forwarded signal")
+	flag.BoolVar(&opts.OrderedRooms, "ordered-rooms", false, "deliver everything within a room in one total order, numbered with seq")
+	flag.BoolVar(&opts.NotifyCallState, "notify-call-state", false, "tell rooms about call-state signals between their members")
+	flag.Float64Var(&opts.RateLimit, "rate-limit", 0, "messages per second allowed per connection (0 disables)")
+	flag.IntVar(&opts.RateBurst, "rate-burst", defaultRateBurst, "burst size allowed above the per-connection rate limit")
+	flag.Float64Var(&opts.ServerRateLimit, "server-rate-limit", 0, "messages per second allowed across all connections (0 disables)")
+	flag.IntVar(&opts.ServerRateBurst, "server-rate-burst", defaultServerRateBurst, "burst size allowed above the server wide rate limit")
+	flag.IntVar(&opts.MaxConnections, "max-connections", 0, "maximum number of open connections (0 is unlimited)")
+	flag.Func("eviction-policy", "what to do with new connections at -max-connections: reject or evict-lru (default reject)", parseEvictionPolicy(&opts.EvictionPolicy))
+	flag.IntVar(&opts.MaxHops, "max-hops", 0, "maximum number of relays a signal may go through (0 is unlimited)")
+	flag.IntVar(&opts.MaxTargets, "max-targets", defaultMaxTargets, "maximum number of peers a signal may be addressed to")
+	flag.BoolVar(&opts.RequireDTLS, "require-dtls", false, "reject SDP that does not negotiate DTLS protected media")
+	flag.IntVar(&opts.SendQueueSize, "send-queue", defaultSendQueueSize, "maximum number of messages queued per connection")
+	flag.Float64Var(&opts.SlowClientThreshold, "slow-client-threshold", 32, "average send queue depth at which a connection is flagged as slow (0 disables)")
+	flag.DurationVar(&opts.QueueSampleInterval, "queue-sample-interval", defaultQueueSampleInterval, "interval between send queue depth samples")
+	flag.StringVar(&opts.DefaultRoom, "default-room", "", "room connections are placed in on connect (empty disables)")
+	flag.Func("sdp-strip-codecs", "comma separated codecs to remove from forwarded SDP", appendList(&opts.SDPStripCodecs))
+	flag.IntVar(&opts.SDPBandwidth, "sdp-bandwidth", 0, "bandwidth in kbps forced on forwarded SDP media sections (0 disables)")
+	flag.IntVar(&opts.SDPValidationMaxBytes, "sdp-validation-max-bytes", 0, "size above which SDP is forwarded without validation or munging (0 is unlimited)")
+	flag.BoolVar(&opts.SDPCapabilities, "sdp-capabilities", false, "strip codecs a target has not advertised from the SDP forwarded to it")
+	flag.DurationVar(&opts.RoomMaxLifetime, "room-max-lifetime", 0, "maximum time a room exists before it is closed (0 disables)")
+	flag.DurationVar(&opts.RoomSoloTimeout, "room-solo-timeout", 0, "time a room may have a single member before it is closed (0 disables)")
+	flag.Func("star-rooms", "comma separated rooms whose members may only signal the room's host", appendList(&opts.StarRooms))
+	flag.IntVar(&opts.MaxMetadataBytes, "max-metadata-bytes", defaultMaxMetadataBytes, "maximum size of the metadata attached to a signal")
+	flag.IntVar(&opts.MaxKeyExchangeBytes, "max-key-exchange-bytes", defaultMaxKeyExchangeBytes, "maximum size of a key-exchange payload")
+	flag.Int64Var(&opts.MaxMessageBytes, "max-message-bytes", defaultMaxMessageBytes, "maximum size of a message from a client")
+	flag.StringVar(&opts.OTLPEndpoint, "otlp-endpoint", "", "OpenTelemetry collector URL to export traces to (empty disables)")
+	flag.IntVar(&opts.PauseQueueSize, "pause-queue", defaultPauseQueueSize, "maximum number of signals held for a paused connection")
+	flag.IntVar(&opts.MaxFrameRate, "max-frame-rate", 0, "WebSocket frames per second a connection may send before it is closed (0 disables)")
+	flag.Func("allowed-origins", "comma separated browser origins allowed to connect (empty allows all)", appendList(&opts.AllowedOrigins))
+	flag.BoolVar(&opts.VerifyPayloadOrigin, "verify-payload-origin", false, "reject messages whose origin field does not match their connection's origin")
+	flag.StringVar(&opts.AcceptWebhook, "accept-webhook", "", "URL asked whether to accept each WebSocket connection (empty accepts all)")
+	flag.DurationVar(&opts.AcceptWebhookTimeout, "accept-webhook-timeout", defaultWebhookTimeout, "time the accept webhook has to answer")
+	flag.StringVar(&opts.Tenants, "tenants", "", "JSON file of tenants to serve over TLS by hostname (empty disables)")
+	flag.BoolVar(&opts.RequireReady, "require-ready", false, "reject signals from connections that have not sent ready")
+	flag.IntVar(&opts.MatchSkillRange, "match-skill-range", 0, "largest skill difference between matched connections (0 ignores skill)")
+	flag.Float64Var(&opts.LoadShedThreshold, "load-shed-threshold", 0, "mean send queue depth at which low priority signals are dropped (0 disables)")
+	flag.DurationVar(&opts.CandidateBatchWindow, "candidate-batch-window", 0, "time candidates for a connection are collected into one batch (0 disables)")
+	flag.IntVar(&opts.CandidateBatchSize, "candidate-batch-size", defaultCandidateBatchSize, "maximum number of candidates in a batch")
+	flag.Int64Var(&opts.MemorySoftLimit, "memory-soft-limit", 0, "heap bytes above which held and batched signals are shed (0 disables)")
+	flag.Int64Var(&opts.MemoryHardLimit, "memory-hard-limit", 0, "heap bytes above which new connections are refused (0 disables)")
+	flag.BoolVar(&opts.LongPoll, "long-poll", false, "serve the long-polling transport on /poll")
+	flag.DurationVar(&opts.LongPollTimeout, "long-poll-timeout", defaultLongPollTimeout, "time a long-polling GET waits for messages")
+	flag.BoolVar(&opts.SSE, "sse", false, "serve the Server-Sent Events transport on /events")
+	flag.DurationVar(&opts.ResumeGrace, "resume-grace", 0, "time a dropped connection can be resumed with its resume token (0 disables)")
+	flag.BoolVar(&opts.ResumeMetadata, "resume-metadata", false, "also restore metadata, tags and aliases when resuming")
+
+	flag.Parse()
+	return opts
+}
+
+// appendList returns a flag.Func setter appending comma separated values to
+// list
+func appendList(list *[]string) func(string) error {
+	return func(value string) error {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*list = append(*list, item)
+			}
+		}
+		return nil
+	}
+}
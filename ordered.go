@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// inRoomOrder runs deliver through the room's sequencer when OrderedRooms
+// is set, handing it the room-wide sequence number to stamp on what it
+// sends. Otherwise, or outside any room, deliver runs at once with 0.
+func (ws *WebSocketServer) inRoomOrder(room string, deliver func(seq uint64)) {
+	if !ws.opts.OrderedRooms || room == "" || !ws.roomManager.Sequence(room, deliver) {
+		deliver(0)
+	}
+}
+
+// sharedRoom returns the room two connections are both in, if any
+func (ws *WebSocketServer) sharedRoom(a string, b string) string {
+	room, ok := ws.roomManager.RoomOf(a)
+	if !ok {
+		return ""
+	}
+	if other, ok := ws.roomManager.RoomOf(b); !ok || other != room {
+		return ""
+	}
+	return room
+}
+
+// stampSequence adds a room sequence number, as "seq", to an encoded
+// message. A seq of 0 means the message is not ordered and leaves it as is.
+func stampSequence(data []byte, seq uint64) []byte {
+	end := bytes.LastIndexByte(data, '}')
+	if seq == 0 || end < 0 {
+		return data
+	}
+
+	stamped := make([]byte, 0, len(data)+24)
+	stamped = append(stamped, data[:end]...)
+	stamped = append(stamped, `,"seq":`...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	stamped = append(stamped, data[end:]...)
+	return stamped
+}
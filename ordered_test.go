@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestOrderedRoomTotalOrder(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{OrderedRooms: true}))
+	var clients []*testClient
+	for i := 0; i < 4; i++ {
+		clients = append(clients, dial(t, srv, "/ws"))
+	}
+	joinAll("r", clients...)
+
+	// Everyone broadcasts at once
+	const broadcasts = 25
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *testClient) {
+			defer wg.Done()
+			for j := 0; j < broadcasts; j++ {
+				client.conn.WriteJSON(map[string]interface{}{"signalType": "broadcast", "data": fmt.Sprintf("%d-%d", i, j)})
+			}
+		}(i, client)
+	}
+	wg.Wait()
+
+	// Each member sees every broadcast but its own, in increasing sequence
+	// order, and every member sees a broadcast under the same number
+	seqs := make(map[interface{}]float64)
+	for _, client := range clients {
+		last := 0.0
+		for k := 0; k < broadcasts*(len(clients)-1); k++ {
+			message := client.readType("broadcast")
+			seq, _ := message["seq"].(float64)
+			if seq <= last {
+				t.Fatalf("broadcast %v after seq %v", message, last)
+			}
+			last = seq
+			if previous, ok := seqs[message["data"]]; ok && previous != seq {
+				t.Fatalf("broadcast %v seen as seq %v and %v", message["data"], previous, seq)
+			}
+			seqs[message["data"]] = seq
+		}
+	}
+	if len(seqs) != broadcasts*len(clients) {
+		t.Fatalf("saw %d broadcasts, want %d", len(seqs), broadcasts*len(clients))
+	}
+}
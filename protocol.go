@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of WebSocket protocol error, as counted in
+// signaller_protocol_errors_total. gorilla/websocket answers all but
+// invalid UTF-8 with a close frame of its own, 1002 or 1009; invalid UTF-8
+// in a text frame is caught here and closed with 1007.
+var protocolErrorKinds = []string{
+	"invalid_utf8",
+	"reserved_bits",
+	"oversized_control_frame",
+	"fragmented_control_frame",
+	"bad_fragmentation",
+	"bad_opcode",
+	"bad_mask",
+	"bad_close_frame",
+	"message_too_large",
+}
+
+// protocolErrorMarkers maps the text of gorilla/websocket's protocol errors
+// to their kind
+var protocolErrorMarkers = []struct {
+	marker string
+	kind   string
+}{
+	{"RSV", "reserved_bits"},
+	{"len > 125 for control", "oversized_control_frame"},
+	{"FIN not set on control", "fragmented_control_frame"},
+	{"data before FIN", "bad_fragmentation"},
+	{"continuation after FIN", "bad_fragmentation"},
+	{"bad opcode", "bad_opcode"},
+	{"bad MASK", "bad_mask"},
+	{"bad close code", "bad_close_frame"},
+	{"invalid utf8 payload in close frame", "bad_close_frame"},
+}
+
+// protocolErrors counts protocol errors by kind
+type protocolErrors map[string]*atomic.Int64
+
+func newProtocolErrors() protocolErrors {
+	counts := make(protocolErrors, len(protocolErrorKinds))
+	for _, kind := range protocolErrorKinds {
+		counts[kind] = &atomic.Int64{}
+	}
+	return counts
+}
+
+// classifyProtocolError returns the kind of protocol error a read failed
+// with, or "" if it failed for another reason such as the connection closing
+func classifyProtocolError(err error) string {
+	if err == websocket.ErrReadLimit {
+		return "message_too_large"
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "websocket: ") {
+		return ""
+	}
+	for _, m := range protocolErrorMarkers {
+		if strings.Contains(err.Error(), m.marker) {
+			return m.kind
+		}
+	}
+	return ""
+}
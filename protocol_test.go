@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestProtocolErrorsClassifiedAndClosed(t *testing.T) {
+	oversizedPing := append([]byte{0x80 | websocket.PingMessage, 0x80 | 126, 0, 130, 0, 0, 0, 0}, make([]byte, 130)...)
+	tests := []struct {
+		kind  string
+		frame []byte
+		code  int
+	}{
+		{"reserved_bits", clientFrame(0x40|websocket.TextMessage, true, "{}"), websocket.CloseProtocolError},
+		{"invalid_utf8", clientFrame(websocket.TextMessage, true, "\"\xff\""), websocket.CloseInvalidFramePayloadData},
+		{"oversized_control_frame", oversizedPing, websocket.CloseProtocolError},
+		{"fragmented_control_frame", clientFrame(websocket.PingMessage, false, ""), websocket.CloseProtocolError},
+		{"bad_opcode", clientFrame(3, true, ""), websocket.CloseProtocolError},
+	}
+
+	ws := NewWebSocketServer(Options{})
+	srv := startServer(t, ws)
+	for _, test := range tests {
+		a := dial(t, srv, "/ws")
+		if _, err := a.conn.NetConn().Write(test.frame); err != nil {
+			t.Fatal(err)
+		}
+		a.expectCloseCode(test.code)
+		waitUnregistered(t, ws, a.id)
+		if count := ws.metrics.protocolErrors[test.kind].Load(); count != 1 {
+			t.Errorf("%s counted %d times", test.kind, count)
+		}
+	}
+	if count := ws.metrics.protocolErrors["bad_mask"].Load(); count != 0 {
+		t.Errorf("bad_mask counted %d times", count)
+	}
+}
+
+func TestClassifyProtocolError(t *testing.T) {
+	if kind := classifyProtocolError(websocket.ErrReadLimit); kind != "message_too_large" {
+		t.Errorf("read limit classified as %q", kind)
+	}
+	if kind := classifyProtocolError(&websocket.CloseError{Code: websocket.CloseNormalClosure}); kind != "" {
+		t.Errorf("normal close classified as %q", kind)
+	}
+}
+
+func TestOversizedMessageClosed(t *testing.T) {
+	ws := NewWebSocketServer(Options{MaxMessageBytes: 64})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	a.send(map[string]string{"signalType": "listRooms", "padding": strings.Repeat("x", 64)})
+	a.expectCloseCode(websocket.CloseMessageTooBig)
+	waitUnregistered(t, ws, a.id)
+	if count := ws.metrics.protocolErrors["message_too_large"].Load(); count != 1 {
+		t.Fatalf("message_too_large counted %d times", count)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestTokenBucketBurst(t *testing.T) {
+	bucket := newTokenBucket(0.001, 3)
+	for i := 0; i < 3; i++ {
+		if !bucket.Allow() {
+			t.Fatalf("event %d within the burst refused", i)
+		}
+	}
+	if bucket.Allow() {
+		t.Fatalf("event past the burst allowed")
+	}
+}
+
+func TestWelcomeAdvertisesRateLimit(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{RateLimit: 1, RateBurst: 2}))
+	a := dial(t, srv, "/ws")
+	limit, ok := a.welcome["rateLimit"].(map[string]interface{})
+	if !ok || limit["messagesPerSecond"] != 1.0 || limit["burst"] != 2.0 {
+		t.Fatalf("welcome advertises %v", a.welcome["rateLimit"])
+	}
+
+	for i := 0; i < 3; i++ {
+		a.send(map[string]string{"signalType": "listRooms"})
+	}
+	a.readType("rooms")
+	a.readType("rooms")
+	a.readError("rate_limited")
+}
+
+func TestWelcomeWithoutRateLimit(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	if a := dial(t, srv, "/ws"); a.welcome["rateLimit"] != nil {
+		t.Fatalf("welcome advertises %v with limiting disabled", a.welcome["rateLimit"])
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// RelayPolicy decides who may send signals to whom within a room, for rooms
+// that need more than roles, like moderated or star topology rooms. It is
+// given the room's roster in join order.
+type RelayPolicy interface {
+	Allow(members []string, from string, to string) bool
+}
+
+// StarPolicy only lets signals flow between the host and the other members,
+// never between two members. With no Host set, the longest standing member
+// is the host.
+type StarPolicy struct {
+	Host string
+}
+
+// Allow implements RelayPolicy
+func (p StarPolicy) Allow(members []string, from string, to string) bool {
+	host := p.Host
+	if host == "" && len(members) > 0 {
+		host = members[0]
+	}
+	return from == host || to == host
+}
+
+// relayPolicies holds the policies embedders registered, by room name. A
+// room keeps its policy when it empties out and is created again.
+type relayPolicies struct {
+	policies map[string]RelayPolicy
+	mutex    sync.RWMutex
+}
+
+// SetRelayPolicy registers the policy consulted for signals sent within a
+// room, replacing any previous one. A nil policy removes it.
+func (ws *WebSocketServer) SetRelayPolicy(room string, policy RelayPolicy) {
+	ws.relayPolicies.mutex.Lock()
+	defer ws.relayPolicies.mutex.Unlock()
+
+	if policy == nil {
+		delete(ws.relayPolicies.policies, room)
+		return
+	}
+	if ws.relayPolicies.policies == nil {
+		ws.relayPolicies.policies = make(map[string]RelayPolicy)
+	}
+	ws.relayPolicies.policies[room] = policy
+}
+
+// relayAllowed reports whether from may send to to. Only signals between
+// two members of the same room are subject to that room's policy.
+func (ws *WebSocketServer) relayAllowed(from string, to string) bool {
+	room, ok := ws.roomManager.RoomOf(from)
+	if !ok {
+		return true
+	}
+	if targetRoom, ok := ws.roomManager.RoomOf(to); !ok || targetRoom != room {
+		return true
+	}
+
+	ws.relayPolicies.mutex.RLock()
+	policy := ws.relayPolicies.policies[room]
+	ws.relayPolicies.mutex.RUnlock()
+
+	return policy == nil || policy.Allow(ws.roomManager.Members(room), from, to)
+}
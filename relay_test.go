@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStarPolicy(t *testing.T) {
+	ws := NewWebSocketServer(Options{StarRooms: []string{"star"}})
+	srv := startServer(t, ws)
+	host := dial(t, srv, "/ws")
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("star", host, a, b)
+
+	// Members only reach each other through the host
+	a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "a-b"})
+	a.readError("relay_denied")
+	a.send(map[string]string{"signalType": "candidate", "userId": host.id, "candidate": "a-host"})
+	if message := host.readType("candidate"); message["candidate"] != "a-host" {
+		t.Fatalf("host got %v", message)
+	}
+	host.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "host-b"})
+	if message := b.readType("candidate"); message["candidate"] != "host-b" {
+		t.Fatalf("member got %v", message)
+	}
+
+	// A member's broadcast only reaches the host
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": "hello"})
+	host.readType("broadcast")
+	b.expectNone(100 * time.Millisecond)
+}
+
+func TestRelayPolicyOnlyAppliesWithinItsRoom(t *testing.T) {
+	ws := NewWebSocketServer(Options{})
+	ws.SetRelayPolicy("star", StarPolicy{})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	joinAll("other", a, b, c)
+
+	b.send(map[string]string{"signalType": "candidate", "userId": c.id, "candidate": "c"})
+	c.readType("candidate")
+
+	ws.SetRelayPolicy("other", StarPolicy{Host: a.id})
+	b.send(map[string]string{"signalType": "candidate", "userId": c.id, "candidate": "c"})
+	b.readError("relay_denied")
+}
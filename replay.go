@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplaySink receives a copy of every forwarded message so that a session
+// can be replayed later. Record must not block the forwarding path.
+type ReplaySink interface {
+	Record(entry ReplayEntry)
+}
+
+// ReplayEntry is one forwarded message as seen by the sink
+type ReplayEntry struct {
+	Time    time.Time       `json:"time"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Message json.RawMessage `json:"message"`
+}
+
+// sensitiveFields are removed from messages, at any depth, before they
+// reach a sink
+var sensitiveFields = map[string]bool{"token": true, "password": true}
+
+// sanitizeMessage strips sensitive fields from an encoded message, the ICE
+// password from the SDP of offers and answers, and the payload of key
+// exchanges. Messages without any are returned as they are.
+func sanitizeMessage(data []byte) json.RawMessage {
+	var message interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&message); err != nil {
+		return data
+	}
+
+	// Key-exchange payloads are key material passed between the peers
+	// untouched, so nothing in them is safe to keep
+	redacted := false
+	if fields, ok := message.(map[string]interface{}); ok && fields["signalType"] == "key-exchange" {
+		if _, ok := fields["payload"]; ok {
+			fields["payload"] = redactedValue
+			redacted = true
+		}
+	}
+	if !sanitizeValue(message) && !redacted {
+		return data
+	}
+	sanitized, err := json.Marshal(message)
+	if err != nil {
+		return data
+	}
+	return sanitized
+}
+
+// sanitizeValue redacts a decoded JSON value in place and reports whether
+// anything was redacted
+func sanitizeValue(value interface{}) bool {
+	redacted := false
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if sensitiveFields[name] {
+				delete(value, name)
+				redacted = true
+				continue
+			}
+			if encoded, ok := field.(string); ok && name == "sdp_base64" {
+				if sdp, ok := redactSDP(encoded); ok {
+					value[name] = sdp
+					redacted = true
+				}
+				continue
+			}
+			redacted = sanitizeValue(field) || redacted
+		}
+	case []interface{}:
+		for _, element := range value {
+			redacted = sanitizeValue(element) || redacted
+		}
+	}
+	return redacted
+}
+
+// redactSDP blanks the ICE passwords in a base64 SDP. It reports false if
+// the SDP has none or does not decode.
+func redactSDP(encoded string) (string, bool) {
+	sdp, err := decodeSDP(encoded)
+	if err != nil {
+		return "", false
+	}
+	lines := strings.SplitAfter(sdp, "\n")
+	redacted := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "a=ice-pwd:") {
+			ending := line[len(strings.TrimRight(line, "\r\n")):]
+			lines[i] = "a=ice-pwd:" + redactedValue + ending
+			redacted = true
+		}
+	}
+	if !redacted {
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, ""))), true
+}
+
+// FileReplaySink appends entries to a file as JSON lines. Entries are queued
+// in a bounded buffer and written by a background goroutine; when the buffer
+// is full new entries are dropped rather than slowing down forwarding.
+type FileReplaySink struct {
+	file    *os.File
+	entries chan ReplayEntry
+	dropped atomic.Int64
+	wg      sync.WaitGroup
+}
+
+// NewFileReplaySink opens path for appending and starts the writer
+func NewFileReplaySink(path string, buffer int) (*FileReplaySink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &FileReplaySink{
+		file:    file,
+		entries: make(chan ReplayEntry, buffer),
+	}
+	sink.wg.Add(1)
+	go sink.run()
+	return sink, nil
+}
+
+// Record queues an entry, dropping it if the buffer is full
+func (s *FileReplaySink) Record(entry ReplayEntry) {
+	select {
+	case s.entries <- entry:
+	default:
+		if s.dropped.Add(1) == 1 {
+			log.Println("❌ Replay sink is full, dropping entries")
+		}
+	}
+}
+
+// Close writes out the queued entries and closes the file
+func (s *FileReplaySink) Close() error {
+	close(s.entries)
+	s.wg.Wait()
+	if dropped := s.dropped.Load(); dropped > 0 {
+		log.Printf("Replay sink dropped %d entries\n", dropped)
+	}
+	return s.file.Close()
+}
+
+func (s *FileReplaySink) run() {
+	defer s.wg.Done()
+
+	encoder := json.NewEncoder(s.file)
+	for entry := range s.entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("❌ Failed to write replay entry: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// icePassword is the ICE password in offerWithICE
+const icePassword = "x9cml/YzichV2+XlhiMu8g"
+
+// offerWithICE is testSDP with the ICE credentials a browser would add
+const offerWithICE = testSDP + "a=ice-ufrag:F7gI\r\na=ice-pwd:" + icePassword + "\r\n"
+
+// startReplay builds a server that records to a file sink, and returns the
+// sink and the path of its file along with it
+func startReplay(t *testing.T, opts Options) (*FileReplaySink, string, *WebSocketServer) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	sink, err := NewFileReplaySink(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.ReplaySink = sink
+	return sink, path, NewWebSocketServer(opts)
+}
+
+// recorded closes the sink and returns what it wrote, raw and as entries
+func recorded(t *testing.T, sink *FileReplaySink, path string) ([]byte, []ReplayEntry) {
+	t.Helper()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ReplayEntry
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		var entry ReplayEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return raw, entries
+}
+
+func TestReplaySinkRecordsInOrder(t *testing.T) {
+	sink, path, ws := startReplay(t, Options{})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	candidates := []string{"1", "2", "3"}
+	for _, candidate := range candidates {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": candidate})
+		b.readType("candidate")
+	}
+
+	var recordedCandidates []string
+	_, entries := recorded(t, sink, path)
+	for _, entry := range entries {
+		if entry.From != a.id || entry.To != b.id {
+			t.Fatalf("entry from %s to %s", entry.From, entry.To)
+		}
+		var message map[string]interface{}
+		json.Unmarshal(entry.Message, &message)
+		recordedCandidates = append(recordedCandidates, message["candidate"].(string))
+	}
+	if strings.Join(recordedCandidates, ",") != strings.Join(candidates, ",") {
+		t.Fatalf("recorded %v, want %v", recordedCandidates, candidates)
+	}
+}
+
+func TestReplaySinkRedactsOffers(t *testing.T) {
+	sink, path, ws := startReplay(t, Options{})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{
+		"signalType": "offer",
+		"userId":     b.id,
+		"sdp_base64": encodeSDP(offerWithICE),
+		"metadata":   map[string]interface{}{"session": map[string]string{"token": "session-secret", "name": "call"}},
+	})
+	if sdp := b.readSDP("offer"); !strings.Contains(sdp, icePassword) {
+		t.Fatalf("target got an offer without its ICE password:\n%s", sdp)
+	}
+
+	raw, entries := recorded(t, sink, path)
+	for _, secret := range []string{icePassword, "session-secret", encodeSDP(offerWithICE)} {
+		if bytes.Contains(raw, []byte(secret)) {
+			t.Fatalf("sink output contains %q:\n%s", secret, raw)
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("recorded %d entries, want 1", len(entries))
+	}
+	var message struct {
+		SDP      string `json:"sdp_base64"`
+		Metadata struct {
+			Session map[string]string `json:"session"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(entries[0].Message, &message)
+	sdp, err := decodeSDP(message.SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sdp, icePassword) || !strings.Contains(sdp, "a=ice-pwd:"+redactedValue+"\r\n") || !strings.Contains(sdp, "a=ice-ufrag:F7gI\r\n") {
+		t.Fatalf("recorded SDP:\n%s", sdp)
+	}
+	if message.Metadata.Session["name"] != "call" {
+		t.Fatalf("recorded metadata %v", message.Metadata)
+	}
+}
+
+func TestSanitizeMessage(t *testing.T) {
+	message := []byte(`{"signalType":"answer","sdp_base64":"` + encodeSDP(offerWithICE) + `","metadata":{"auth":[{"password":"pw"}]}}`)
+	sanitized := sanitizeMessage(message)
+	if bytes.Contains(sanitized, []byte(`"password"`)) || bytes.Contains(sanitized, []byte(encodeSDP(offerWithICE))) {
+		t.Fatalf("sanitized to %s", sanitized)
+	}
+
+	clean := []byte(`{"signalType":"offer","sdp_base64":"` + encodeSDP(testSDP) + `","metadata":{"hops":1}}`)
+	if string(sanitizeMessage(clean)) != string(clean) {
+		t.Fatalf("message without secrets was re-encoded")
+	}
+}
+
+func TestReplaySinkRedactsKeyExchange(t *testing.T) {
+	sink, path, ws := startReplay(t, Options{})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	key := "MCowBQYDK2VuAyEAhUe3bPwKXoJtXUq8OFqRcOoy"
+	a.send(map[string]interface{}{"signalType": "key-exchange", "userId": b.id, "payload": map[string]string{"publicKey": key, "curve": "x25519"}})
+	if message := b.readType("key-exchange"); message["payload"].(map[string]interface{})["publicKey"] != key {
+		t.Fatalf("target got %v", message)
+	}
+
+	raw, entries := recorded(t, sink, path)
+	if bytes.Contains(raw, []byte(key)) || bytes.Contains(raw, []byte("x25519")) {
+		t.Fatalf("sink output contains key material:\n%s", raw)
+	}
+	var message map[string]interface{}
+	if len(entries) == 1 {
+		json.Unmarshal(entries[0].Message, &message)
+	}
+	if message["signalType"] != "key-exchange" || message["payload"] != redactedValue {
+		t.Fatalf("recorded %s", raw)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxMessageIDBytes caps the messageId a replay window remembers
+const maxMessageIDBytes = 128
+
+// replayWindow remembers the (sender, messageId) pairs it has seen within
+// the last window. Unlike dedup, which quietly drops repeats of the same
+// bytes, it lets the sender know a message was replayed.
+type replayWindow struct {
+	window    time.Duration
+	seen      map[replayKey]time.Time
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+type replayKey struct {
+	sender    string
+	messageID string
+}
+
+func newReplayWindow(window time.Duration) *replayWindow {
+	return &replayWindow{
+		window:    window,
+		seen:      make(map[replayKey]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Seen reports whether the same sender already sent a message with this ID
+// within the window
+func (rw *replayWindow) Seen(sender string, messageID string) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	at, ok := rw.seen[replayKey{sender, messageID}]
+	return ok && time.Since(at) <= rw.window
+}
+
+// Record remembers a message the server accepted
+func (rw *replayWindow) Record(sender string, messageID string) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(rw.lastSweep) > rw.window {
+		for key, at := range rw.seen {
+			if now.Sub(at) > rw.window {
+				delete(rw.seen, key)
+			}
+		}
+		rw.lastSweep = now
+	}
+	rw.seen[replayKey{sender, messageID}] = now
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{ReplayWindow: 200 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	message := map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c", "messageId": "m1"}
+
+	a.send(message)
+	b.readType("candidate")
+	a.send(message)
+	a.readError("replay_detected")
+	b.expectNone(50 * time.Millisecond)
+
+	// Message IDs are the sender's own
+	b.send(map[string]string{"signalType": "candidate", "userId": a.id, "candidate": "c", "messageId": "m1"})
+	a.readType("candidate")
+
+	time.Sleep(250 * time.Millisecond)
+	a.send(message)
+	if forwarded := b.readType("candidate"); forwarded["messageId"] != "m1" {
+		t.Fatalf("got %v once the window passed", forwarded)
+	}
+}
+
+func TestReplayWindowRejectsLongMessageIDs(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{ReplayWindow: time.Minute}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c", "messageId": strings.Repeat("x", maxMessageIDBytes+1)})
+	a.readError("invalid_message_id")
+}
+
+func TestReplayWindowRecordsAcceptedMessages(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{ReplayWindow: time.Minute, RequireReady: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	message := map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c", "messageId": "m1"}
+
+	// A message turned away may be sent again with the same ID
+	a.send(message)
+	a.readError("not_ready")
+	a.send(map[string]string{"signalType": "ready"})
+	a.send(message)
+	b.readType("candidate")
+
+	a.send(message)
+	a.readError("replay_detected")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// ConnectionProfile is what a client tells the server about itself with
+// "set-metadata": an application defined metadata object, tags, and aliases
+// other clients can address it by instead of its ID
+type ConnectionProfile struct {
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+	Aliases  []string        `json:"aliases,omitempty"`
+}
+
+// ProfileMessage represents a "set-metadata" request, which replaces the
+// client's whole profile
+type ProfileMessage struct {
+	SignalType string `json:"signalType"`
+	ConnectionProfile
+}
+
+// resumeState is what a client that disconnected gets back if it
+// reconnects with its resume token within the grace window
+type resumeState struct {
+	id       string
+	identity string
+	room     string
+	role     string
+	profile  ConnectionProfile
+}
+
+// resumeStore keeps the state of recently disconnected clients by resume
+// token until their grace window ends
+type resumeStore struct {
+	states map[string]*resumeState
+	mutex  sync.Mutex
+}
+
+// save keeps state under token for grace
+func (rs *resumeStore) save(token string, state *resumeState, grace time.Duration) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.states == nil {
+		rs.states = make(map[string]*resumeState)
+	}
+	rs.states[token] = state
+
+	time.AfterFunc(grace, func() {
+		rs.mutex.Lock()
+		defer rs.mutex.Unlock()
+		if rs.states[token] == state {
+			delete(rs.states, token)
+		}
+	})
+}
+
+// take removes and returns the state saved under token, unless usable
+// turns it down, in which case the token stays valid. A token can only be
+// used once.
+func (rs *resumeStore) take(token string, usable func(*resumeState) bool) (*resumeState, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	state, ok := rs.states[token]
+	if !ok || !usable(state) {
+		return nil, false
+	}
+	delete(rs.states, token)
+	return state, true
+}
+
+// resumeFor looks up the state a connecting client asked to resume with the
+// resume query parameter. Nothing is resumed while the ID is in use.
+func (ws *WebSocketServer) resumeFor(token string) (*resumeState, bool) {
+	if ws.opts.ResumeGrace <= 0 || token == "" {
+		return nil, false
+	}
+	return ws.resumes.take(token, func(state *resumeState) bool {
+		_, inUse := ws.connectionManager.Get(state.id)
+		return !inUse
+	})
+}
+
+// saveResumeState remembers a closing client's identity, room, role and,
+// with ResumeMetadata, profile, so that it can resume them. Clients that
+// asked to disconnect are not resumable.
+func (ws *WebSocketServer) saveResumeState(client *Client) {
+	if client.resumeToken == "" || !client.resumable.Load() {
+		return
+	}
+
+	state := &resumeState{id: client.ID(), identity: client.Identity}
+	if room, ok := ws.roomManager.RoomOf(client.ID()); ok {
+		state.room = room
+		state.role = ws.roomManager.RoleOf(client.ID())
+	}
+	if ws.opts.ResumeMetadata {
+		state.profile = client.Profile()
+	}
+	ws.resumes.save(client.resumeToken, state, ws.opts.ResumeGrace)
+}
+
+// restoreResumeState gives a resuming client back what it had
+func (ws *WebSocketServer) restoreResumeState(client *Client, state *resumeState) {
+	log.Printf("[%s] Resumed 🔁\n", client.ID())
+	if ws.opts.ResumeMetadata {
+		if ws.connectionManager.SetAliases(client.ID(), state.profile.Aliases) {
+			client.SetProfile(state.profile)
+		} else {
+			// Someone else took one of the aliases in the meantime
+			state.profile.Aliases = nil
+			client.SetProfile(state.profile)
+		}
+	}
+	if state.room != "" {
+		members, previous, err := ws.roomManager.Restore(state.room, client.ID(), state.role)
+		ws.joined(client, state.room, state.role, members, previous, err)
+	}
+}
+
+// setProfile replaces a client's profile
+func (ws *WebSocketServer) setProfile(client *Client, profile ConnectionProfile) {
+	if profile.Metadata != nil {
+		if err := ws.checkMetadata(profile.Metadata); err != nil {
+			ws.sendError(client, err)
+			return
+		}
+	}
+	if !ws.connectionManager.SetAliases(client.ID(), profile.Aliases) {
+		ws.sendError(client, errAliasInUse)
+		return
+	}
+	client.SetProfile(profile)
+
+	confirmation := ProfileMessage{SignalType: "metadata_updated", ConnectionProfile: profile}
+	if err := client.WriteJSON(confirmation); err != nil {
+		log.Printf("❌ Failed to confirm metadata: %v\n", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeRestoresProfile(t *testing.T) {
+	ws := NewWebSocketServer(Options{ResumeGrace: time.Minute, ResumeMetadata: true})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	token, _ := a.welcome["resumeToken"].(string)
+	if token == "" {
+		t.Fatalf("welcome has no resume token: %v", a.welcome)
+	}
+	a.join("r")
+	a.send(map[string]interface{}{"signalType": "set-metadata", "metadata": map[string]string{"name": "Alice"}, "tags": []string{"host"}, "aliases": []string{"alice"}})
+	a.readType("metadata_updated")
+
+	a.conn.Close()
+	waitUnregistered(t, ws, a.id)
+	resumed := dial(t, srv, "/ws?resume="+token)
+	if resumed.id != a.id || resumed.welcome["resumed"] != true {
+		t.Fatalf("welcome %v, want %s resumed", resumed.welcome, a.id)
+	}
+	profile, _ := resumed.welcome["profile"].(map[string]interface{})
+	metadata, _ := profile["metadata"].(map[string]interface{})
+	if metadata["name"] != "Alice" || len(profile["tags"].([]interface{})) != 1 || len(profile["aliases"].([]interface{})) != 1 {
+		t.Fatalf("restored profile %v", profile)
+	}
+	if joined := resumed.readType("joined"); joined["room"] != "r" {
+		t.Fatalf("rejoined %v", joined)
+	}
+
+	// The alias addresses the resumed connection again
+	b.send(map[string]string{"signalType": "candidate", "userId": "alice", "candidate": "c"})
+	if message := resumed.readType("candidate"); message["userId"] != b.id {
+		t.Fatalf("got %v", message)
+	}
+}
+
+func TestResumeTokenIsSingleUse(t *testing.T) {
+	ws := NewWebSocketServer(Options{ResumeGrace: time.Minute})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	token := a.welcome["resumeToken"].(string)
+
+	a.conn.Close()
+	waitUnregistered(t, ws, a.id)
+	resumed := dial(t, srv, "/ws?resume="+token)
+	if resumed.id != a.id {
+		t.Fatalf("resumed as %s, want %s", resumed.id, a.id)
+	}
+
+	// Asking to disconnect ends the connection for good
+	resumed.send(map[string]string{"signalType": "disconnect"})
+	resumed.expectClose()
+	waitUnregistered(t, ws, a.id)
+	for _, token := range []string{token, resumed.welcome["resumeToken"].(string)} {
+		if again := dial(t, srv, "/ws?resume="+token); again.id == a.id || again.welcome["resumed"] == true {
+			t.Fatalf("resumed with a used token: %v", again.welcome)
+		}
+	}
+}
+
+func TestResumeTokenKeptWhileIDInUse(t *testing.T) {
+	ws := NewWebSocketServer(Options{ResumeGrace: time.Minute})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	ws.resumes.save("token", &resumeState{id: a.id}, time.Minute)
+
+	// The token does nothing while its ID is taken, but is not used up
+	if early := dial(t, srv, "/ws?resume=token"); early.id == a.id || early.welcome["resumed"] == true {
+		t.Fatalf("resumed an ID in use: %v", early.welcome)
+	}
+	a.conn.Close()
+	waitUnregistered(t, ws, a.id)
+	if resumed := dial(t, srv, "/ws?resume=token"); resumed.id != a.id {
+		t.Fatalf("resumed as %s, want %s", resumed.id, a.id)
+	}
+}
+
+func TestResumeRestoresIdentity(t *testing.T) {
+	ws := NewWebSocketServer(Options{ResumeGrace: time.Minute, IdentitySecret: "k"})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	token := a.welcome["resumeToken"].(string)
+	a.upgradeIdentity("k", "alice")
+
+	a.conn.Close()
+	waitUnregistered(t, ws, a.id)
+	resumed := dial(t, srv, "/ws?resume="+token)
+	if resumed.id != "alice" {
+		t.Fatalf("resumed as %s, want alice", resumed.id)
+	}
+
+	// Signals addressed to the identity reach the resumed connection
+	b.send(map[string]string{"signalType": "candidate", "identity": "alice", "candidate": "c"})
+	if message := resumed.readType("candidate"); message["userId"] != b.id {
+		t.Fatalf("got %v", message)
+	}
+
+	// and it is dropped from the identity once it closes again
+	resumed.conn.Close()
+	waitUnregistered(t, ws, "alice")
+	if _, ok := ws.connectionManager.MostRecent("alice"); ok {
+		t.Fatalf("closed connection still bound to its identity")
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Room roles. Spectators receive room broadcasts and peer events but cannot
+// send signals.
+const (
+	RoleParticipant = "participant"
+	RoleSpectator   = "spectator"
+)
+
+// unclaimedRoomTTL is how long a room created with "createRoom" is kept
+// while nobody has joined it yet
+const unclaimedRoomTTL = 5 * time.Minute
+
+// RoomOptions are the settings a client may choose when creating a room.
+// Rooms that come into existence by simply being joined have none.
+type RoomOptions struct {
+	// MaxMembers caps the number of members, zero means no limit
+	MaxMembers int `json:"maxMembers,omitempty"`
+	// Private rooms are left out of "listRooms" results
+	Private bool `json:"private,omitempty"`
+	// Password, when set, must be given to join
+	Password string `json:"password,omitempty"`
+}
+
+// RoomInfo describes a public room in "listRooms" results
+type RoomInfo struct {
+	Room              string `json:"room"`
+	Members           int    `json:"members"`
+	MaxMembers        int    `json:"maxMembers,omitempty"`
+	PasswordProtected bool   `json:"passwordProtected"`
+}
+
+// Room is a named group of connections. Members are kept in join order so
+// that peers can be addressed by their position in the roster.
+type Room struct {
+	Name    string
+	Options RoomOptions
+	members []string
+
+	// created is set for rooms made with "createRoom" rather than by
+	// joining a room that did not exist
+	created bool
+
+	// lifetime closes the room once it has existed for maxLifetime
+	lifetime *time.Timer
+
+	// solo closes the room once it has had a single member for
+	// soloTimeout; it runs only while the room has exactly one member
+	solo *time.Timer
+
+	// sequence is the last sequence number Sequence handed out; deliveries
+	// hold sequenceMutex while they run
+	sequence      uint64
+	sequenceMutex sync.Mutex
+}
+
+// RoomManager tracks rooms and which room, and in which role, each
+// connection belongs to
+type RoomManager struct {
+	rooms    map[string]*Room
+	memberOf map[string]string
+	roles    map[string]string
+	mutex    sync.RWMutex
+
+	// maxLifetime, when set, closes every room that long after it came
+	// into existence. onClose is told about rooms closed this way, along
+	// with the members they had.
+	maxLifetime time.Duration
+	onClose     func(name string, members []string, reason string)
+
+	// soloTimeout, when set, closes rooms that have had only one member for
+	// that long, as nobody is there to call
+	soloTimeout time.Duration
+}
+
+// NewRoomManager creates a new RoomManager
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms:    make(map[string]*Room),
+		memberOf: make(map[string]string),
+		roles:    make(map[string]string),
+	}
+}
+
+// Create makes a new, empty room with the given options and returns its
+// generated name. The room is dropped if nobody joins it in time.
+func (rm *RoomManager) Create(options RoomOptions) string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	name := uuid.New().String()
+	rm.addLocked(&Room{Name: name, Options: options, created: true})
+
+	time.AfterFunc(unclaimedRoomTTL, func() {
+		rm.mutex.Lock()
+		defer rm.mutex.Unlock()
+		if room, exists := rm.rooms[name]; exists && len(room.members) == 0 {
+			rm.deleteLocked(room)
+		}
+	})
+
+	return name
+}
+
+// Join puts a connection into a room, leaving its previous room if any.
+// It returns the new roster and the name of the room that was left. Joining
+// fails, leaving the connection where it was, if the room is full or the
+// password does not match.
+func (rm *RoomManager) Join(name string, id string, role string, password string) (members []string, previous string, err error) {
+	return rm.join(name, id, role, &password)
+}
+
+// Restore puts a resuming connection back into the room it was in. It needs
+// no password, having been let in before, but the room may have filled up.
+func (rm *RoomManager) Restore(name string, id string, role string) (members []string, previous string, err error) {
+	return rm.join(name, id, role, nil)
+}
+
+// join implements Join, skipping the password check if password is nil
+func (rm *RoomManager) join(name string, id string, role string, password *string) (members []string, previous string, err error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	current, inRoom := rm.memberOf[id]
+	if inRoom && current == name {
+		rm.roles[id] = role
+		return rm.rooms[name].roster(), "", nil
+	}
+
+	room, exists := rm.rooms[name]
+	if exists {
+		if password != nil && room.Options.Password != "" && subtle.ConstantTimeCompare([]byte(*password), []byte(room.Options.Password)) != 1 {
+			return nil, "", errWrongPassword
+		}
+		if room.Options.MaxMembers > 0 && len(room.members) >= room.Options.MaxMembers {
+			return nil, "", errRoomFull
+		}
+	}
+
+	if inRoom {
+		rm.removeLocked(current, id)
+		previous = current
+	}
+	if !exists {
+		room = &Room{Name: name}
+		rm.addLocked(room)
+	}
+	room.members = append(room.members, id)
+	rm.memberOf[id] = name
+	rm.roles[id] = role
+	rm.watchSoloLocked(room)
+
+	return room.roster(), previous, nil
+}
+
+// Public lists the rooms that were created public. Rooms that were never
+// explicitly created are not listed.
+func (rm *RoomManager) Public() []RoomInfo {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+
+	rooms := []RoomInfo{}
+	for name, room := range rm.rooms {
+		if !room.created || room.Options.Private {
+			continue
+		}
+		rooms = append(rooms, RoomInfo{
+			Room:              name,
+			Members:           len(room.members),
+			MaxMembers:        room.Options.MaxMembers,
+			PasswordProtected: room.Options.Password != "",
+		})
+	}
+	return rooms
+}
+
+// Leave removes a connection from its room and returns the room name and
+// the remaining roster
+func (rm *RoomManager) Leave(id string) (name string, members []string, ok bool) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	name, ok = rm.memberOf[id]
+	if !ok {
+		return "", nil, false
+	}
+	members = rm.removeLocked(name, id)
+	return name, members, true
+}
+
+// RoomOf returns the room a connection is currently in
+func (rm *RoomManager) RoomOf(id string) (string, bool) {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	name, ok := rm.memberOf[id]
+	return name, ok
+}
+
+// RoleOf returns a connection's role in its room, or "" if it is not in one
+func (rm *RoomManager) RoleOf(id string) string {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	return rm.roles[id]
+}
+
+// Members returns a copy of a room's roster in join order
+func (rm *RoomManager) Members(name string) []string {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	room, exists := rm.rooms[name]
+	if !exists {
+		return nil
+	}
+	return room.roster()
+}
+
+// Sequence runs deliver with the room's next sequence number. Only one
+// delivery runs per room at a time, so members receive whatever they are
+// sent in sequence order. It returns false, without calling deliver, if
+// there is no such room.
+func (rm *RoomManager) Sequence(name string, deliver func(seq uint64)) bool {
+	rm.mutex.RLock()
+	room, exists := rm.rooms[name]
+	rm.mutex.RUnlock()
+	if !exists {
+		return false
+	}
+
+	room.sequenceMutex.Lock()
+	defer room.sequenceMutex.Unlock()
+	room.sequence++
+	deliver(room.sequence)
+	return true
+}
+
+// MemberAt resolves a roster position to a connection ID
+func (rm *RoomManager) MemberAt(name string, index int) (string, bool) {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	room, exists := rm.rooms[name]
+	if !exists || index < 0 || index >= len(room.members) {
+		return "", false
+	}
+	return room.members[index], true
+}
+
+// Rename replaces a member's ID, keeping its position in the roster
+func (rm *RoomManager) Rename(oldID string, newID string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	name, ok := rm.memberOf[oldID]
+	if !ok {
+		return
+	}
+	delete(rm.memberOf, oldID)
+	rm.memberOf[newID] = name
+	rm.roles[newID] = rm.roles[oldID]
+	delete(rm.roles, oldID)
+
+	room := rm.rooms[name]
+	for i, member := range room.members {
+		if member == oldID {
+			room.members[i] = newID
+			break
+		}
+	}
+}
+
+// Snapshot returns the roster of every room
+func (rm *RoomManager) Snapshot() map[string][]string {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	rooms := make(map[string][]string, len(rm.rooms))
+	for name, room := range rm.rooms {
+		rooms[name] = room.roster()
+	}
+	return rooms
+}
+
+// addLocked registers a new room and starts its lifetime timer. Callers must
+// hold the write lock.
+func (rm *RoomManager) addLocked(room *Room) {
+	rm.rooms[room.Name] = room
+	if rm.maxLifetime > 0 {
+		room.lifetime = time.AfterFunc(rm.maxLifetime, func() {
+			rm.closeRoom(room, "lifetime_exceeded")
+		})
+	}
+}
+
+// watchSoloLocked starts the solo timer of a room that is down to one
+// member and stops it once the room has more. Callers must hold the write
+// lock.
+func (rm *RoomManager) watchSoloLocked(room *Room) {
+	if rm.soloTimeout <= 0 {
+		return
+	}
+	if len(room.members) != 1 {
+		if room.solo != nil {
+			room.solo.Stop()
+			room.solo = nil
+		}
+		return
+	}
+	if room.solo != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(rm.soloTimeout, func() {
+		// Someone may have joined just as the timer fired
+		rm.closeRoomIf(room, "solo_timeout", func() bool {
+			return room.solo == timer
+		})
+	})
+	room.solo = timer
+}
+
+// closeRoom removes a room and all of its members, then reports it to
+// onClose. It does nothing if room is no longer registered, e.g. because it
+// emptied out and a new room with the same name was created since.
+func (rm *RoomManager) closeRoom(room *Room, reason string) {
+	rm.closeRoomIf(room, reason, func() bool { return true })
+}
+
+// closeRoomIf closes a room like closeRoom, provided that still, checked
+// under the write lock, reports true
+func (rm *RoomManager) closeRoomIf(room *Room, reason string, still func() bool) {
+	rm.mutex.Lock()
+	if rm.rooms[room.Name] != room || !still() {
+		rm.mutex.Unlock()
+		return
+	}
+	members := room.roster()
+	for _, member := range members {
+		delete(rm.memberOf, member)
+		delete(rm.roles, member)
+	}
+	rm.deleteLocked(room)
+	rm.mutex.Unlock()
+
+	if rm.onClose != nil {
+		rm.onClose(room.Name, members, reason)
+	}
+}
+
+// deleteLocked unregisters a room and stops its timers. Callers must hold
+// the write lock.
+func (rm *RoomManager) deleteLocked(room *Room) {
+	delete(rm.rooms, room.Name)
+	if room.lifetime != nil {
+		room.lifetime.Stop()
+	}
+	if room.solo != nil {
+		room.solo.Stop()
+	}
+}
+
+// removeLocked drops a member while preserving the order of the others and
+// deletes the room once it is empty. Callers must hold the write lock.
+func (rm *RoomManager) removeLocked(name string, id string) []string {
+	delete(rm.memberOf, id)
+	delete(rm.roles, id)
+
+	room, exists := rm.rooms[name]
+	if !exists {
+		return nil
+	}
+	for i, member := range room.members {
+		if member == id {
+			room.members = append(room.members[:i], room.members[i+1:]...)
+			break
+		}
+	}
+	if len(room.members) == 0 {
+		rm.deleteLocked(room)
+		return nil
+	}
+	rm.watchSoloLocked(room)
+	return room.roster()
+}
+
+func (r *Room) roster() []string {
+	members := make([]string, len(r.members))
+	copy(members, r.members)
+	return members
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// joinAll puts every client in room, in order
+func joinAll(room string, clients ...*testClient) {
+	for _, client := range clients {
+		client.join(room)
+	}
+}
+
+func TestPeerIndexAddressing(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+
+	a.send(map[string]interface{}{"signalType": "offer", "peerIndex": 1, "sdp_base64": "eA=="})
+	if message := b.readType("offer"); message["userId"] != a.id {
+		t.Fatalf("offer from %v, want %s", message["userId"], a.id)
+	}
+}
+
+func TestPeerIndexOutOfRange(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	a.join("r")
+
+	for _, index := range []int{1, -1} {
+		a.send(map[string]interface{}{"signalType": "candidate", "peerIndex": index, "candidate": "c"})
+		a.readError("peer_index_out_of_range")
+	}
+}
+
+func TestPeerIndexOrderIsStable(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	joinAll("r", a, b, c)
+
+	targets := map[int]*testClient{1: b, 2: c}
+	for round := 0; round < 3; round++ {
+		for index, target := range targets {
+			a.send(map[string]interface{}{"signalType": "candidate", "peerIndex": index, "candidate": "c"})
+			if message := target.readType("candidate"); message["userId"] != a.id {
+				t.Fatalf("round %d: index %d reached the wrong peer", round, index)
+			}
+		}
+	}
+
+	// Leaving shifts later members down without reordering them
+	b.send(map[string]string{"signalType": "leave"})
+	a.readType("peer_left")
+	a.send(map[string]interface{}{"signalType": "candidate", "peerIndex": 1, "candidate": "c"})
+	c.readType("candidate")
+}
+
+// members returns the string IDs of a roster in a message
+func members(message map[string]interface{}) []string {
+	var ids []string
+	for _, id := range message["members"].([]interface{}) {
+		ids = append(ids, id.(string))
+	}
+	return ids
+}
+
+func TestLivenessReflectsMembership(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{LivenessInterval: 50 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+
+	for _, client := range []*testClient{a, b} {
+		if roster := members(client.readType("liveness")); len(roster) != 2 {
+			t.Fatalf("liveness roster %v, want both members", roster)
+		}
+	}
+
+	// A broadcast already underway may still list b, but the next ones
+	// must not
+	b.conn.Close()
+	a.readType("peer_left")
+	a.readType("liveness")
+	if roster := members(a.readType("liveness")); len(roster) != 1 || roster[0] != a.id {
+		t.Fatalf("liveness roster %v after leaving, want only %s", roster, a.id)
+	}
+}
+
+func TestSpectatorReceivesButCannotSend(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	s := dial(t, srv, "/ws")
+	a.join("r")
+	s.send(map[string]string{"signalType": "join", "room": "r", "role": "spectator"})
+	s.readType("joined")
+	if message := a.readType("peer_joined"); message["role"] != RoleSpectator {
+		t.Fatalf("peer_joined role %v, want spectator", message["role"])
+	}
+
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": map[string]int{"x": 1}})
+	if message := s.readType("broadcast"); message["userId"] != a.id {
+		t.Fatalf("broadcast from %v, want %s", message["userId"], a.id)
+	}
+
+	s.send(map[string]interface{}{"signalType": "offer", "userId": a.id, "sdp_base64": "eA=="})
+	s.readError("spectator")
+	s.send(map[string]interface{}{"signalType": "broadcast", "data": 1})
+	s.readError("spectator")
+	a.expectNone(100 * time.Millisecond)
+}
+
+func TestJoinWithUnknownRole(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	a.send(map[string]string{"signalType": "join", "room": "r", "role": "owner"})
+	a.readError("invalid_role")
+}
+
+func TestDefaultRoom(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{DefaultRoom: "lobby"}))
+	a := dial(t, srv, "/ws")
+	if message := a.readType("joined"); message["room"] != "lobby" {
+		t.Fatalf("joined %v, want lobby", message["room"])
+	}
+	b := dial(t, srv, "/ws")
+	b.readType("joined")
+	a.readType("peer_joined")
+
+	b.send(map[string]interface{}{"signalType": "broadcast", "data": "hi"})
+	if message := a.readType("broadcast"); message["userId"] != b.id || message["data"] != "hi" {
+		t.Fatalf("broadcast %v", message)
+	}
+}
+
+func TestNoDefaultRoom(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	a.expectNone(100 * time.Millisecond)
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": "hi"})
+	a.readError("not_in_room")
+}
+
+// createRoom creates a room with options and returns its handle
+func (c *testClient) createRoom(options map[string]interface{}) string {
+	c.t.Helper()
+	message := map[string]interface{}{"signalType": "createRoom"}
+	for name, value := range options {
+		message[name] = value
+	}
+	c.send(message)
+	return c.readType("room_created")["room"].(string)
+}
+
+func TestCreatePasswordProtectedRoom(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	room := a.createRoom(map[string]interface{}{"password": "pw"})
+
+	b.send(map[string]string{"signalType": "join", "room": room, "password": "wrong"})
+	b.readError("wrong_password")
+	b.send(map[string]string{"signalType": "join", "room": room})
+	b.readError("wrong_password")
+	b.send(map[string]string{"signalType": "join", "room": room, "password": "pw"})
+	if message := b.readType("joined"); message["room"] != room {
+		t.Fatalf("joined %v, want %s", message["room"], room)
+	}
+}
+
+func TestCreateRoomOptions(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	public := a.createRoom(map[string]interface{}{"maxMembers": 2})
+	a.createRoom(map[string]interface{}{"private": true})
+
+	a.send(map[string]string{"signalType": "listRooms"})
+	rooms := a.readType("rooms")["rooms"].([]interface{})
+	if len(rooms) != 1 || rooms[0].(map[string]interface{})["room"] != public {
+		t.Fatalf("listed %v, want only %s", rooms, public)
+	}
+
+	joinAll(public, a, b)
+	c.send(map[string]string{"signalType": "join", "room": public})
+	c.readError("room_full")
+
+	a.send(map[string]interface{}{"signalType": "createRoom", "maxMembers": -1})
+	a.readError("invalid_room_options")
+}
+
+func TestRoomMaxLifetime(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{RoomMaxLifetime: 200 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	joinAll("r", a, b)
+	opened := time.Now()
+
+	for _, member := range []*testClient{a, b} {
+		message := member.readType("room_closed")
+		if message["room"] != "r" || message["reason"] != "lifetime_exceeded" {
+			t.Fatalf("room_closed %v", message)
+		}
+	}
+	if elapsed := time.Since(opened); elapsed < 150*time.Millisecond {
+		t.Fatalf("room closed after %s, before its lifetime", elapsed)
+	}
+
+	// Members are out of the room, which can be opened afresh
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": 1})
+	a.readError("not_in_room")
+	a.join("r")
+}
+
+func TestRoomSoloTimeout(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{RoomSoloTimeout: 200 * time.Millisecond}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	// A peer arriving in time stops the timer
+	a.join("r")
+	time.Sleep(100 * time.Millisecond)
+	b.join("r")
+	a.readType("peer_joined")
+	a.expectNone(250 * time.Millisecond)
+
+	// Once alone again the member is left waiting for a full timeout
+	b.send(map[string]string{"signalType": "leave"})
+	a.readType("peer_left")
+	alone := time.Now()
+	if message := a.readType("room_closed"); message["room"] != "r" || message["reason"] != "solo_timeout" {
+		t.Fatalf("room_closed %v", message)
+	}
+	if elapsed := time.Since(alone); elapsed < 150*time.Millisecond {
+		t.Fatalf("room closed after %s alone, before the timeout", elapsed)
+	}
+	a.send(map[string]interface{}{"signalType": "broadcast", "data": 1})
+	a.readError("not_in_room")
+}
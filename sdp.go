@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// decodeSDP decodes the base64 SDP carried by offers and answers
+func decodeSDP(encoded string) (string, error) {
+	sdp, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(sdp), nil
+}
+
+// sdpLines splits an SDP body into lines, accepting both CRLF and LF
+func sdpLines(sdp string) []string {
+	return strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n")
+}
+
+// isSecureSDP reports whether an SDP negotiates DTLS protected media: it
+// must carry a DTLS fingerprint, and every media section must use a
+// (D)TLS based transport rather than plain RTP/AVP or SDES keyed RTP/SAVP
+func isSecureSDP(sdp string) bool {
+	hasFingerprint := false
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "a=fingerprint:"):
+			hasFingerprint = true
+		case strings.HasPrefix(line, "m="):
+			// m=<media> <port> <proto> <fmt> ...
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.Contains(fields[2], "TLS") {
+				return false
+			}
+		}
+	}
+	return hasFingerprint
+}
+
+// sdpSession is an SDP body split into the session level lines and one
+// block of lines per media section, each starting with its m= line
+type sdpSession struct {
+	lineEnding string
+	session    []string
+	media      [][]string
+}
+
+// parseSDP splits an SDP body into sections
+func parseSDP(sdp string) *sdpSession {
+	s := &sdpSession{lineEnding: "\n"}
+	if strings.Contains(sdp, "\r\n") {
+		s.lineEnding = "\r\n"
+	}
+
+	lines := sdpLines(strings.TrimRight(sdp, "\r\n"))
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			s.media = append(s.media, []string{line})
+		case len(s.media) > 0:
+			s.media[len(s.media)-1] = append(s.media[len(s.media)-1], line)
+		default:
+			s.session = append(s.session, line)
+		}
+	}
+	return s
+}
+
+// String reassembles the SDP body with its original line endings
+func (s *sdpSession) String() string {
+	var b strings.Builder
+	for _, line := range s.session {
+		b.WriteString(line + s.lineEnding)
+	}
+	for _, section := range s.media {
+		for _, line := range section {
+			b.WriteString(line + s.lineEnding)
+		}
+	}
+	return b.String()
+}
+
+// Codecs lists the distinct encoding names of every a=rtpmap line
+func (s *sdpSession) Codecs() []string {
+	seen := make(map[string]bool)
+	var codecs []string
+	for _, section := range s.media {
+		for _, line := range section {
+			_, encoding, ok := rtpmap(line)
+			if ok && !seen[strings.ToLower(encoding)] {
+				seen[strings.ToLower(encoding)] = true
+				codecs = append(codecs, encoding)
+			}
+		}
+	}
+	return codecs
+}
+
+// RemoveCodecs drops the named codecs (matched case-insensitively against
+// a=rtpmap encoding names) from every media section, along with their
+// fmtp and rtcp-fb attributes, any RTX payloads tied to them, and their
+// payload types in the m= line. A section left without formats is rejected
+// by setting its port to 0, keeping its formats as the grammar requires.
+func (s *sdpSession) RemoveCodecs(names []string) {
+	for i, section := range s.media {
+		removed := make(map[string]bool)
+		for _, line := range section {
+			pt, encoding, ok := rtpmap(line)
+			if !ok {
+				continue
+			}
+			for _, name := range names {
+				if strings.EqualFold(encoding, name) {
+					removed[pt] = true
+				}
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+
+		// RTX payloads reference the codec they repair via apt=
+		for _, line := range section {
+			pt, params, ok := attributeForPayload(line, "a=fmtp:")
+			if ok && removed[fmtpParam(params, "apt")] {
+				removed[pt] = true
+			}
+		}
+
+		kept := make([]string, 0, len(section))
+		for j, line := range section {
+			if j == 0 {
+				kept = append(kept, removePayloadTypes(line, removed))
+				if len(strings.Fields(kept[0])) < 4 {
+					kept[0] = rejectMedia(line)
+				}
+				continue
+			}
+			if pt, ok := payloadAttribute(line); ok && removed[pt] {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		s.media[i] = kept
+	}
+}
+
+// SetBandwidth replaces any bandwidth lines in audio and video sections with
+// b=AS:<kbps>, placed after the section's c= line as the SDP grammar requires
+func (s *sdpSession) SetBandwidth(kbps int) {
+	bandwidth := "b=AS:" + strconv.Itoa(kbps)
+
+	for i, section := range s.media {
+		kind := strings.TrimPrefix(strings.Fields(section[0])[0], "m=")
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+
+		kept := []string{section[0]}
+		insertAt := 1
+		for _, line := range section[1:] {
+			if strings.HasPrefix(line, "b=") {
+				continue
+			}
+			kept = append(kept, line)
+			if strings.HasPrefix(line, "i=") || strings.HasPrefix(line, "c=") {
+				insertAt = len(kept)
+			}
+		}
+
+		kept = append(kept[:insertAt], append([]string{bandwidth}, kept[insertAt:]...)...)
+		s.media[i] = kept
+	}
+}
+
+// rtpmap parses "a=rtpmap:<pt> <encoding>/<clock>[/<channels>]"
+func rtpmap(line string) (pt string, encoding string, ok bool) {
+	pt, value, ok := attributeForPayload(line, "a=rtpmap:")
+	if !ok {
+		return "", "", false
+	}
+	encoding, _, _ = strings.Cut(value, "/")
+	return pt, encoding, true
+}
+
+// attributeForPayload parses "<prefix><pt> <value>"
+func attributeForPayload(line string, prefix string) (pt string, value string, ok bool) {
+	rest, ok := strings.CutPrefix(line, prefix)
+	if !ok {
+		return "", "", false
+	}
+	pt, value, ok = strings.Cut(rest, " ")
+	return pt, value, ok
+}
+
+// fmtpParam returns the value of one parameter in the ";" separated list of
+// an a=fmtp line, such as "apt=96;rtx-time=3000"
+func fmtpParam(params string, name string) string {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// payloadAttribute returns the payload type a per-codec attribute line
+// (rtpmap, fmtp or rtcp-fb) applies to
+func payloadAttribute(line string) (string, bool) {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if pt, _, ok := attributeForPayload(line, prefix); ok {
+			return pt, true
+		}
+	}
+	return "", false
+}
+
+// removePayloadTypes drops payload types from an m= line's format list
+func removePayloadTypes(mline string, removed map[string]bool) string {
+	// m=<media> <port> <proto> <fmt> ...
+	fields := strings.Fields(mline)
+	if len(fields) < 4 {
+		return mline
+	}
+	kept := fields[:3]
+	for _, format := range fields[3:] {
+		if !removed[format] {
+			kept = append(kept, format)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// rejectMedia sets an m= line's port to 0
+func rejectMedia(mline string) string {
+	fields := strings.Fields(mline)
+	if len(fields) < 2 {
+		return mline
+	}
+	fields[1] = "0"
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// testSDP is an offer with DTLS protected audio and video
+const testSDP = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=fingerprint:sha-256 AA:BB\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:30\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97 98\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtcp-fb:96 nack\r\n" +
+	"a=rtpmap:97 rtx/90000\r\n" +
+	"a=fmtp:97 apt=96\r\n" +
+	"a=rtpmap:98 H264/90000\r\n" +
+	"a=fmtp:98 profile-level-id=42e01f\r\n"
+
+func encodeSDP(sdp string) string {
+	return base64.StdEncoding.EncodeToString([]byte(sdp))
+}
+
+// readSDP waits for an offer or answer and decodes its SDP
+func (c *testClient) readSDP(signalType string) string {
+	c.t.Helper()
+	message := c.readType(signalType)
+	sdp, err := decodeSDP(message["sdp_base64"].(string))
+	if err != nil {
+		c.t.Fatalf("forwarded SDP is not valid base64: %v", err)
+	}
+	return sdp
+}
+
+func TestIsSecureSDP(t *testing.T) {
+	tests := []struct {
+		sdp    string
+		secure bool
+	}{
+		{testSDP, true},
+		{"v=0\na=fingerprint:sha-256 AA\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel", true},
+		{"v=0\r\nm=audio 9 RTP/AVP 0\r\n", false},
+		{"v=0\r\na=fingerprint:sha-256 AA\r\nm=audio 9 RTP/AVP 0\r\n", false},
+		{"v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\n", false},
+	}
+	for _, test := range tests {
+		if isSecureSDP(test.sdp) != test.secure {
+			t.Errorf("isSecureSDP(%q) = %v", test.sdp, !test.secure)
+		}
+	}
+}
+
+func TestRequireDTLS(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{RequireDTLS: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP("v=0\r\nm=audio 9 RTP/AVP 0\r\n")})
+	a.readError("insecure_sdp")
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP(testSDP)})
+	if sdp := b.readSDP("offer"); sdp != testSDP {
+		t.Fatalf("secure SDP changed in transit: %q", sdp)
+	}
+}
+
+func TestRemoveCodecs(t *testing.T) {
+	session := parseSDP(testSDP)
+	session.RemoveCodecs([]string{"vp8"})
+	sdp := session.String()
+
+	for _, gone := range []string{" 96", "VP8", "a=rtcp-fb:96", "rtx", "apt=96"} {
+		if strings.Contains(sdp, gone) {
+			t.Errorf("%q left in %q", gone, sdp)
+		}
+	}
+	for _, kept := range []string{"m=video 9 UDP/TLS/RTP/SAVPF 98\r\n", "a=rtpmap:98 H264/90000", "a=rtpmap:111 opus/48000/2"} {
+		if !strings.Contains(sdp, kept) {
+			t.Errorf("%q missing from %q", kept, sdp)
+		}
+	}
+}
+
+func TestRemoveCodecsWithRTXParameters(t *testing.T) {
+	session := parseSDP(strings.Replace(testSDP, "a=fmtp:97 apt=96\r\n", "a=fmtp:97 apt=96;rtx-time=3000\r\n", 1))
+	session.RemoveCodecs([]string{"VP8"})
+	if sdp := session.String(); strings.Contains(sdp, "rtx") || !strings.Contains(sdp, "m=video 9 UDP/TLS/RTP/SAVPF 98\r\n") {
+		t.Fatalf("RTX for VP8 left in %q", sdp)
+	}
+}
+
+func TestRemoveCodecsRejectsEmptySection(t *testing.T) {
+	session := parseSDP(testSDP)
+	session.RemoveCodecs([]string{"vp8", "h264"})
+	sdp := session.String()
+
+	if !strings.Contains(sdp, "m=video 0 UDP/TLS/RTP/SAVPF 96 97 98\r\n") || strings.Contains(sdp, "a=rtpmap:9") {
+		t.Fatalf("video section not rejected in %q", sdp)
+	}
+	if !strings.Contains(sdp, "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n") {
+		t.Fatalf("audio section changed in %q", sdp)
+	}
+}
+
+func TestSetBandwidth(t *testing.T) {
+	session := parseSDP(testSDP)
+	session.SetBandwidth(500)
+	sdp := session.String()
+
+	if strings.Contains(sdp, "b=AS:30") || strings.Count(sdp, "b=AS:500\r\n") != 2 {
+		t.Fatalf("bandwidth not forced in %q", sdp)
+	}
+	// b= lines follow the c= line of their section
+	if !strings.Contains(sdp, "c=IN IP4 0.0.0.0\r\nb=AS:500\r\na=rtpmap:96") {
+		t.Fatalf("bandwidth line misplaced in %q", sdp)
+	}
+}
+
+func TestSDPMungingOnForward(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{SDPStripCodecs: []string{"VP8"}, SDPBandwidth: 500}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP(testSDP)})
+	sdp := b.readSDP("offer")
+	if strings.Contains(sdp, "VP8") || !strings.Contains(sdp, "b=AS:500") {
+		t.Fatalf("forwarded SDP not munged: %q", sdp)
+	}
+	if !strings.HasSuffix(sdp, "\r\n") {
+		t.Fatalf("line endings not preserved: %q", sdp)
+	}
+}
+
+func TestSDPValidationSizeCap(t *testing.T) {
+	ws := NewWebSocketServer(Options{RequireDTLS: true, SDPValidationMaxBytes: 256})
+	srv := startServer(t, ws)
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	insecure := "v=0\r\nm=audio 9 RTP/AVP 0\r\n"
+
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP(insecure)})
+	a.readError("insecure_sdp")
+	if ws.metrics.sdpValidations.Load() != 1 || ws.metrics.sdpValidationNanos.Load() <= 0 {
+		t.Fatalf("%d validations taking %dns, want one timed validation", ws.metrics.sdpValidations.Load(), ws.metrics.sdpValidationNanos.Load())
+	}
+
+	// Past the cap even an insecure SDP goes through unchecked
+	oversized := insecure + strings.Repeat("a=x\r\n", 100)
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": encodeSDP(oversized)})
+	if sdp := b.readSDP("offer"); sdp != oversized {
+		t.Fatalf("oversized SDP changed in transit")
+	}
+	if ws.metrics.sdpValidations.Load() != 1 || ws.metrics.sdpValidationsSkipped.Load() != 1 {
+		t.Fatalf("%d validations and %d skipped, want one of each", ws.metrics.sdpValidations.Load(), ws.metrics.sdpValidationsSkipped.Load())
+	}
+}
+
+func TestSDPAdaptedToTargetCapabilities(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{SDPCapabilities: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	b.send(map[string]interface{}{"signalType": "capabilities", "codecs": []string{"opus", "vp8"}})
+	b.readType("capabilities_updated")
+
+	a.send(map[string]interface{}{"signalType": "offer", "userIds": []string{b.id, c.id}, "sdp_base64": encodeSDP(testSDP)})
+	sdp := b.readSDP("offer")
+	if strings.Contains(sdp, "H264") || !strings.Contains(sdp, "m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n") {
+		t.Fatalf("H264 left in %q", sdp)
+	}
+	for _, kept := range []string{"a=rtpmap:111 opus/48000/2", "a=rtpmap:96 VP8/90000", "a=fmtp:97 apt=96"} {
+		if !strings.Contains(sdp, kept) {
+			t.Errorf("%q missing from %q", kept, sdp)
+		}
+	}
+
+	// A target that advertised nothing gets the SDP as it was sent
+	if sdp := c.readSDP("offer"); sdp != testSDP {
+		t.Fatalf("SDP changed for a target without capabilities: %q", sdp)
+	}
+}
+
+func TestSDPAdaptationRejectsUnsupportedSections(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{SDPCapabilities: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+	c := dial(t, srv, "/ws")
+	b.send(map[string]interface{}{"signalType": "capabilities", "codecs": []string{"opus"}})
+	b.readType("capabilities_updated")
+	c.send(map[string]interface{}{"signalType": "capabilities", "codecs": []string{"opus", "h264"}})
+	c.readType("capabilities_updated")
+
+	offer := strings.Replace(testSDP, "a=fmtp:97 apt=96\r\n", "a=fmtp:97 apt=96;rtx-time=3000\r\n", 1)
+	a.send(map[string]interface{}{"signalType": "offer", "userIds": []string{b.id, c.id}, "sdp_base64": encodeSDP(offer)})
+
+	// An audio only target gets the video section rejected
+	sdp := b.readSDP("offer")
+	if !strings.Contains(sdp, "m=video 0 ") || strings.Contains(sdp, "a=rtpmap:9") || !strings.Contains(sdp, "a=rtpmap:111 opus/48000/2") {
+		t.Fatalf("audio only target got %q", sdp)
+	}
+
+	// RTX goes with the codec it repairs
+	sdp = c.readSDP("offer")
+	if strings.Contains(sdp, "rtx") || !strings.Contains(sdp, "m=video 9 UDP/TLS/RTP/SAVPF 98\r\n") {
+		t.Fatalf("RTX for a stripped codec left in %q", sdp)
+	}
+}
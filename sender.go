@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sender is the transport a client's messages are written to. WebSocket
+// connections and long-polling sessions both implement it, so that nothing
+// past the read loop needs to know how a client is connected. A client
+// holds its writeMutex around every call to Send and SendClose.
+type Sender interface {
+	// Send writes one message, giving up after writeWait
+	Send(data []byte) error
+	// SendClose tells the client the connection is ending and why, with a
+	// WebSocket close code, without closing the transport yet
+	SendClose(code int, reason string)
+	// Close ends the transport
+	Close() error
+}
+
+// bufferedSender is a Sender that holds messages until the client comes to
+// fetch them. Pending takes the messages it is still holding, so that they
+// can follow the client to another transport.
+type bufferedSender interface {
+	Sender
+	Pending() [][]byte
+}
+
+// websocketSender writes to a WebSocket connection
+type websocketSender struct {
+	conn *websocket.Conn
+}
+
+func (s websocketSender) Send(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s websocketSender) SendClose(code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	s.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+func (s websocketSender) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sseHistorySize is how many sent events a session keeps for resending to
+// a stream that reconnects with Last-Event-ID
+const sseHistorySize = 64
+
+type sseEvent struct {
+	id   uint64
+	data []byte
+}
+
+// sseStream tracks a session's event stream. Only one stream is current at a
+// time; a reconnecting stream takes over from the one before it. Events are
+// numbered and kept as they are taken from the mailbox, by whichever stream
+// takes them, and the current stream sends each of them once.
+type sseStream struct {
+	cancel  context.CancelFunc
+	wake    chan struct{}
+	lastID  uint64
+	sentID  uint64
+	history []sseEvent
+	mutex   sync.Mutex
+}
+
+// take makes the caller the session's only stream. It picks up after the
+// event numbered lastEventID when that is given, returning the kept events
+// it missed, or else after the latest event. The returned channel is
+// signaled when there are more events to send.
+func (s *sseStream) take(ctx context.Context, lastEventID string) (context.Context, chan struct{}, []sseEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wake = make(chan struct{}, 1)
+	s.sentID = s.lastID
+	if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil && id < s.lastID {
+		s.sentID = id
+	}
+	return ctx, s.wake, s.unsentLocked()
+}
+
+// record numbers an event and keeps it for the current stream to send
+func (s *sseStream) record(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastID++
+	s.history = append(s.history, sseEvent{id: s.lastID, data: data})
+	if len(s.history) > sseHistorySize {
+		s.history = s.history[1:]
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// unsent returns the events the stream given wake has yet to send and marks
+// them sent. A stream that was taken over gets none.
+func (s *sseStream) unsent(wake chan struct{}) []sseEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if wake != s.wake {
+		return nil
+	}
+	return s.unsentLocked()
+}
+
+func (s *sseStream) unsentLocked() []sseEvent {
+	var events []sseEvent
+	for _, event := range s.history {
+		if event.id > s.sentID {
+			events = append(events, event)
+		}
+	}
+	s.sentID = s.lastID
+	return events
+}
+
+// dropHistory forgets the events already sent, so that a stream
+// reconnecting after them misses them
+func (s *sseStream) dropHistory() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var kept []sseEvent
+	for _, event := range s.history {
+		if event.id > s.sentID {
+			kept = append(kept, event)
+		}
+	}
+	s.history = kept
+}
+
+// handleEvents is the Server-Sent Events transport: the same sessions as
+// long-polling (POST to open one and to send), but GET streams messages as
+// events for as long as the request stays open. A stream reconnecting with
+// Last-Event-ID first gets the events it missed, as far as they are kept.
+func (ws *WebSocketServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	ws.handleSession(w, r, ws.streamEvents)
+}
+
+// streamEvents writes a session's messages to an event stream
+func (ws *WebSocketServer) streamEvents(w http.ResponseWriter, r *http.Request, session *pollSession) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming_unsupported", "streaming is not supported")
+		return
+	}
+	ctx, wake, backlog := session.stream.take(r.Context(), r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range backlog {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	// Comments keep proxies from timing the stream out and show that the
+	// client is still there
+	heartbeat := time.NewTicker(ws.opts.LongPollTimeout)
+	defer heartbeat.Stop()
+
+	for {
+		session.lastPoll.Store(time.Now().UnixNano())
+		select {
+		case data := <-session.sender.mailbox:
+			session.stream.record(data)
+		case <-wake:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-session.sender.closed:
+			reason, _ := session.sender.reason.Load().(string)
+			for _, data := range session.sender.drain() {
+				session.stream.record(data)
+			}
+			for _, event := range session.stream.unsent(wake) {
+				writeEvent(w, event)
+			}
+			fmt.Fprintf(w, "event: close\ndata: %s\n\n", reason)
+			flusher.Flush()
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		// Events this stream recorded after it was taken over are sent by
+		// the stream that took over
+		for _, event := range session.stream.unsent(wake) {
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one event. Key exchange payloads are forwarded as sent
+// and may span lines, ended by CRLF, CR or LF, so each line gets its own
+// data field.
+func writeEvent(w http.ResponseWriter, event sseEvent) {
+	fmt.Fprintf(w, "id: %d\n", event.id)
+	data := bytes.ReplaceAll(event.data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	id      string
+	message map[string]interface{}
+}
+
+// streamEvents opens the session's event stream, resuming after lastID
+// unless it is empty, and returns the events it sends
+func (p *pollClient) streamEvents(lastID string) <-chan testEvent {
+	p.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.t.Cleanup(func() { resp.Body.Close() })
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		p.t.Fatalf("stream has Content-Type %s", contentType)
+	}
+
+	events := make(chan testEvent, 64)
+	go func() {
+		defer close(events)
+		var event testEvent
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			case line == "" && event.id != "":
+				json.Unmarshal([]byte(strings.Join(data, "\n")), &event.message)
+				events <- event
+				event, data = testEvent{}, nil
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent waits for the next event on a stream
+func nextEvent(t *testing.T, events <-chan testEvent) testEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("event stream ended")
+		}
+		return event
+	case <-time.After(readTimeout):
+		t.Fatalf("no event")
+	}
+	return testEvent{}
+}
+
+func TestSSEReceivesForwards(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{SSE: true}))
+	a := openSession(t, srv, "/events")
+	w := dial(t, srv, "/ws")
+
+	events := a.streamEvents("")
+	if event := nextEvent(t, events); event.message["signalType"] != "welcome" || event.message["userId"] != a.id {
+		t.Fatalf("first event %v", event)
+	}
+	for _, candidate := range []string{"1", "2"} {
+		w.send(map[string]string{"signalType": "candidate", "userId": a.id, "candidate": candidate})
+		if event := nextEvent(t, events); event.message["candidate"] != candidate || event.message["userId"] != w.id {
+			t.Fatalf("got %v, want candidate %s", event, candidate)
+		}
+	}
+
+	// Sending still goes over POST
+	a.send(map[string]string{"signalType": "candidate", "userId": w.id, "candidate": "from-sse"})
+	if message := w.readType("candidate"); message["userId"] != a.id {
+		t.Fatalf("got %v", message)
+	}
+}
+
+func TestSSEReconnectWithLastEventID(t *testing.T) {
+	srv := startServer(t, NewWebSocketServer(Options{SSE: true}))
+	a := openSession(t, srv, "/events")
+	w := dial(t, srv, "/ws")
+
+	events := a.streamEvents("")
+	welcome := nextEvent(t, events)
+	for _, candidate := range []string{"1", "2"} {
+		w.send(map[string]string{"signalType": "candidate", "userId": a.id, "candidate": candidate})
+		nextEvent(t, events)
+	}
+
+	// The new stream takes over and first resends what came after the
+	// welcome
+	resumed := a.streamEvents(welcome.id)
+	for _, candidate := range []string{"1", "2"} {
+		if event := nextEvent(t, resumed); event.message["candidate"] != candidate {
+			t.Fatalf("resent %v, want candidate %s", event, candidate)
+		}
+	}
+	w.send(map[string]string{"signalType": "candidate", "userId": a.id, "candidate": "3"})
+	if event := nextEvent(t, resumed); event.message["candidate"] != "3" || event.id != "4" {
+		t.Fatalf("got %v after reconnecting", event)
+	}
+}
+
+func TestSSETakeoverSendsEachEventOnce(t *testing.T) {
+	var stream sseStream
+	_, first, _ := stream.take(context.Background(), "")
+	stream.record([]byte("1"))
+	stream.unsent(first)
+
+	// An event the first stream took from the mailbox as the second one
+	// took over is sent by the second
+	_, second, backlog := stream.take(context.Background(), "")
+	stream.record([]byte("2"))
+	if len(backlog) != 0 || len(stream.unsent(first)) != 0 {
+		t.Fatalf("replaced stream still sends")
+	}
+	select {
+	case <-second:
+	default:
+		t.Fatalf("current stream not woken")
+	}
+	if events := stream.unsent(second); len(events) != 1 || string(events[0].data) != "2" {
+		t.Fatalf("current stream sends %v", events)
+	}
+
+	// A stream resuming after the first event gets the second once
+	_, third, backlog := stream.take(context.Background(), "1")
+	if len(backlog) != 1 || backlog[0].id != 2 || len(stream.unsent(third)) != 0 {
+		t.Fatalf("resumed with %v", backlog)
+	}
+}
+
+func TestWriteEventSplitsLines(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeEvent(recorder, sseEvent{id: 7, data: []byte("a\r\nb\rc\nd")})
+	if body := recorder.Body.String(); body != "id: 7\ndata: a\ndata: b\ndata: c\ndata: d\n\n" {
+		t.Fatalf("wrote %q", body)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TenantConfig is one tenant in the -tenants file. Each tenant is served
+// under its own hostname, picked by TLS SNI, and gets a server of its own,
+// so connection IDs and rooms never cross between tenants.
+type TenantConfig struct {
+	Hostname string `json:"hostname"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// These override the corresponding command line options
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	IdentitySecret string   `json:"identitySecret,omitempty"`
+	AdminToken     string   `json:"adminToken,omitempty"`
+
+	// Limits of the tenant's own, so that one tenant cannot use up the
+	// capacity others rely on; zero keeps the command line option
+	RateLimit       float64 `json:"rateLimit,omitempty"`
+	RateBurst       int     `json:"rateBurst,omitempty"`
+	ServerRateLimit float64 `json:"serverRateLimit,omitempty"`
+	ServerRateBurst int     `json:"serverRateBurst,omitempty"`
+	MaxConnections  int     `json:"maxConnections,omitempty"`
+}
+
+// loadTenants reads a JSON array of tenants
+func loadTenants(path string) ([]TenantConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []TenantConfig
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return tenants, nil
+}
+
+// tenant is a configured tenant with its certificate and server
+type tenant struct {
+	tlsConfig *tls.Config
+	server    *WebSocketServer
+	handler   http.Handler
+}
+
+// TenantRouter serves several tenants from one listener, telling them apart
+// by the hostname clients ask for in the TLS handshake
+type TenantRouter struct {
+	tenants map[string]*tenant
+}
+
+// NewTenantRouter starts a server for every tenant, each with base options
+// overridden by the tenant's own settings
+func NewTenantRouter(base Options, configs []TenantConfig) (*TenantRouter, error) {
+	router := &TenantRouter{tenants: make(map[string]*tenant)}
+	for _, config := range configs {
+		hostname := strings.ToLower(config.Hostname)
+		if hostname == "" {
+			return nil, fmt.Errorf("tenant without a hostname")
+		}
+		if _, exists := router.tenants[hostname]; exists {
+			return nil, fmt.Errorf("tenant %s configured twice", hostname)
+		}
+
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate for %s: %w", hostname, err)
+		}
+
+		opts := base
+		if len(config.AllowedOrigins) > 0 {
+			opts.AllowedOrigins = config.AllowedOrigins
+		}
+		if config.IdentitySecret != "" {
+			opts.IdentitySecret = config.IdentitySecret
+		}
+		if config.AdminToken != "" {
+			opts.AdminToken = config.AdminToken
+		}
+		if config.RateLimit > 0 {
+			opts.RateLimit = config.RateLimit
+		}
+		if config.RateBurst > 0 {
+			opts.RateBurst = config.RateBurst
+		}
+		if config.ServerRateLimit > 0 {
+			opts.ServerRateLimit = config.ServerRateLimit
+		}
+		if config.ServerRateBurst > 0 {
+			opts.ServerRateBurst = config.ServerRateBurst
+		}
+		if config.MaxConnections > 0 {
+			opts.MaxConnections = config.MaxConnections
+		}
+		server := NewWebSocketServer(opts)
+
+		router.tenants[hostname] = &tenant{
+			tlsConfig: &tls.Config{
+				Certificates: []tls.Certificate{certificate},
+				NextProtos:   []string{"http/1.1"},
+			},
+			server:  server,
+			handler: server.routes(),
+		}
+	}
+	return router, nil
+}
+
+// TLSConfig returns the listener's TLS configuration, which hands each
+// handshake over to the configuration of the tenant it names. Handshakes
+// for unknown hostnames, or without SNI, are refused.
+func (tr *TenantRouter) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			t, ok := tr.tenants[strings.ToLower(hello.ServerName)]
+			if !ok {
+				return nil, fmt.Errorf("no tenant for server name %q", hello.ServerName)
+			}
+			return t.tlsConfig, nil
+		},
+	}
+}
+
+// ServeHTTP passes a request on to the tenant whose hostname its TLS
+// connection was made for
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		httpError(w, http.StatusMisdirectedRequest, "no_tenant", "tenants are only served over TLS")
+		return
+	}
+	t, ok := tr.tenants[strings.ToLower(r.TLS.ServerName)]
+	if !ok {
+		httpError(w, http.StatusMisdirectedRequest, "no_tenant", "no tenant for this hostname")
+		return
+	}
+	t.handler.ServeHTTP(w, r)
+}
+
+// Stop stops every tenant's background work
+func (tr *TenantRouter) Stop() {
+	for _, t := range tr.tenants {
+		t.server.Stop()
+	}
+}
+
+// CloseAll closes every tenant's connections
+func (tr *TenantRouter) CloseAll() {
+	for _, t := range tr.tenants {
+		t.server.CloseAll()
+	}
+}
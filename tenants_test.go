@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeCertificate writes a self-signed certificate for hostname and returns
+// the paths of the certificate and key files
+func writeCertificate(t *testing.T, hostname string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTenants serves tenants over TLS until the test ends. Each tenant
+// gets a certificate for its hostname.
+func startTenants(t *testing.T, base Options, configs ...TenantConfig) *httptest.Server {
+	t.Helper()
+	for i := range configs {
+		configs[i].CertFile, configs[i].KeyFile = writeCertificate(t, configs[i].Hostname)
+	}
+	router, err := NewTenantRouter(base, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = router.TLSConfig()
+	srv.StartTLS()
+	t.Cleanup(func() {
+		srv.Close()
+		router.CloseAll()
+		router.Stop()
+	})
+	return srv
+}
+
+// dialTenant connects to the tenant serving hostname
+func dialTenant(t *testing.T, srv *httptest.Server, hostname string, header http.Header) (*testClient, error) {
+	t.Helper()
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{ServerName: hostname, InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial(wsURL(srv, "/ws"), header)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := newTestClient(t, conn)
+	client.welcome = client.readType("welcome")
+	client.id, _ = client.welcome["userId"].(string)
+	return client, nil
+}
+
+func TestTenantsAreIsolatedBySNI(t *testing.T) {
+	srv := startTenants(t, Options{},
+		TenantConfig{Hostname: "a.test"},
+		TenantConfig{Hostname: "b.test", AllowedOrigins: []string{"https://b.example"}},
+	)
+	a1, err := dialTenant(t, srv, "a.test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := dialTenant(t, srv, "a.test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := dialTenant(t, srv, "b.test", http.Header{"Origin": {"https://b.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections only see the connections and rooms of their own tenant
+	a2.send(map[string]string{"signalType": "candidate", "userId": a1.id, "candidate": "c"})
+	a1.readType("candidate")
+	b.send(map[string]string{"signalType": "candidate", "userId": a1.id, "candidate": "c"})
+	b.readError("target_not_found")
+
+	a1.createRoom(nil)
+	for _, test := range []struct {
+		client *testClient
+		rooms  int
+	}{{a2, 1}, {b, 0}} {
+		test.client.send(map[string]string{"signalType": "listRooms"})
+		rooms, _ := test.client.readType("rooms")["rooms"].([]interface{})
+		if len(rooms) != test.rooms {
+			t.Fatalf("tenant lists rooms %v, want %d", rooms, test.rooms)
+		}
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	srv := startTenants(t, Options{},
+		TenantConfig{Hostname: "a.test"},
+		TenantConfig{Hostname: "b.test", AllowedOrigins: []string{"https://b.example"}},
+	)
+	if _, err := dialTenant(t, srv, "b.test", http.Header{"Origin": {"https://evil.example"}}); err == nil {
+		t.Fatalf("tenant accepted an origin outside its allowed origins")
+	}
+	if _, err := dialTenant(t, srv, "a.test", http.Header{"Origin": {"https://evil.example"}}); err != nil {
+		t.Fatalf("another tenant's origins applied: %v", err)
+	}
+	if _, err := dialTenant(t, srv, "c.test", nil); err == nil {
+		t.Fatalf("connected to an unknown hostname")
+	}
+}
+
+func TestTenantLimitsAreIsolated(t *testing.T) {
+	srv := startTenants(t, Options{},
+		TenantConfig{Hostname: "a.test", MaxConnections: 1, ServerRateLimit: 0.01, ServerRateBurst: 2},
+		TenantConfig{Hostname: "b.test"},
+	)
+	a, err := dialTenant(t, srv, "a.test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialTenant(t, srv, "a.test", nil); err == nil {
+		t.Fatalf("tenant went over its connection limit")
+	}
+	for i := 0; i < 2; i++ {
+		a.touch()
+	}
+	a.send(map[string]string{"signalType": "listRooms"})
+	a.readError("server_rate_limited")
+
+	// The other tenant still has all of its capacity
+	b1, err := dialTenant(t, srv, "b.test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := dialTenant(t, srv, "b.test", nil)
+	if err != nil {
+		t.Fatalf("tenant refused for another tenant's connection limit: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		b1.touch()
+	}
+	b1.send(map[string]string{"signalType": "candidate", "userId": b2.id, "candidate": "c"})
+	b2.readType("candidate")
+}
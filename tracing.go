@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the server's spans
+const tracerName = "webrtc-signaller"
+
+// propagator reads and writes W3C trace context, both on the WebSocket
+// upgrade request and on the traceparent/tracestate fields of signals
+var propagator = propagation.TraceContext{}
+
+// newOTLPTracerProvider exports spans over OTLP/HTTP to endpoint, a
+// collector URL such as http://localhost:4318
+func newOTLPTracerProvider(ctx context.Context, endpoint string, instanceID string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(
+		semconv.ServiceName(tracerName),
+		semconv.ServiceInstanceID(instanceID),
+	)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// TraceFields carries trace context on a signal. Clients may set it to
+// make the server's spans part of their trace; forwarded signals carry the
+// server's forward span so the receiving peer can continue the trace.
+type TraceFields struct {
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// extract returns ctx with the trace context from the fields, if any
+func (f TraceFields) extract(ctx context.Context) context.Context {
+	if f.TraceParent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{
+		"traceparent": f.TraceParent,
+		"tracestate":  f.TraceState,
+	})
+}
+
+// inject replaces the fields with the trace context of ctx
+func (f *TraceFields) inject(ctx context.Context) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	f.TraceParent = carrier.Get("traceparent")
+	f.TraceState = carrier.Get("tracestate")
+}
+
+// stamp adds the fields to an encoded signal. Forwards are stamped once dedup
+// has looked at them, as every forward has a span, and so a traceparent, of
+// its own.
+func (f TraceFields) stamp(data []byte) []byte {
+	end := bytes.LastIndexByte(data, '}')
+	if f.TraceParent == "" || end < 0 {
+		return data
+	}
+
+	traceParent, _ := json.Marshal(f.TraceParent)
+	stamped := make([]byte, 0, len(data)+128)
+	stamped = append(stamped, data[:end]...)
+	stamped = append(stamped, `,"traceparent":`...)
+	stamped = append(stamped, traceParent...)
+	if f.TraceState != "" {
+		traceState, _ := json.Marshal(f.TraceState)
+		stamped = append(stamped, `,"tracestate":`...)
+		stamped = append(stamped, traceState...)
+	}
+	stamped = append(stamped, data[end:]...)
+	return stamped
+}
+
+// requestTraceContext returns the trace context sent with the upgrade request
+func requestTraceContext(r *http.Request) context.Context {
+	return propagator.Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+}
+
+// tracerFor returns the server's tracer from provider, or from the global
+// provider (a no-op unless one is installed) when provider is nil
+func tracerFor(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// connectionAttributes describe the connection a span belongs to
+func connectionAttributes(id string) trace.SpanStartEventOption {
+	return trace.WithAttributes(attribute.String("signaller.connection_id", id))
+}
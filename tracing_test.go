@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracerProvider records spans in memory, as soon as they end
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider, exporter
+}
+
+// endedSpan waits for a span to end and returns it
+func endedSpan(exporter *tracetest.InMemoryExporter, name string) (tracetest.SpanStub, bool) {
+	for deadline := time.Now().Add(readTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name {
+				return span, true
+			}
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestForwardSpans(t *testing.T) {
+	provider, exporter := newTestTracerProvider(t)
+	srv := startServer(t, NewWebSocketServer(Options{TracerProvider: provider}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	// The client's trace context makes the server's spans part of its trace
+	clientTrace := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	a.send(map[string]interface{}{"signalType": "offer", "userId": b.id, "sdp_base64": "eA==", "traceparent": clientTrace})
+	message := b.readType("offer")
+
+	if _, ok := endedSpan(exporter, "signaller.connect"); !ok {
+		t.Fatalf("no connect span")
+	}
+	receive, ok := endedSpan(exporter, "signaller.receive")
+	if !ok {
+		t.Fatalf("no receive span")
+	}
+	if receive.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("receive span not part of the client's trace")
+	}
+	forward, ok := endedSpan(exporter, "signaller.forward")
+	if !ok {
+		t.Fatalf("no forward span")
+	}
+	if forward.Parent.SpanID() != receive.SpanContext.SpanID() {
+		t.Fatalf("forward span is not a child of the receive span")
+	}
+
+	// The target can continue the trace from the forward span
+	want := "00-" + forward.SpanContext.TraceID().String() + "-" + forward.SpanContext.SpanID().String() + "-01"
+	if message["traceparent"] != want {
+		t.Fatalf("forwarded traceparent %v, want %s", message["traceparent"], want)
+	}
+}
+
+func TestDisconnectSpan(t *testing.T) {
+	provider, exporter := newTestTracerProvider(t)
+	srv := startServer(t, NewWebSocketServer(Options{TracerProvider: provider}))
+	a := dial(t, srv, "/ws")
+	a.send(map[string]string{"signalType": "disconnect"})
+	a.expectClose()
+
+	span, ok := endedSpan(exporter, "signaller.disconnect")
+	if !ok {
+		t.Fatalf("no disconnect span")
+	}
+	for _, attribute := range span.Attributes {
+		if attribute.Key == "signaller.connection_id" && attribute.Value.AsString() == a.id {
+			return
+		}
+	}
+	t.Fatalf("disconnect span lacks the connection ID: %v", span.Attributes)
+}
+
+func TestDedupWithTracing(t *testing.T) {
+	provider, _ := newTestTracerProvider(t)
+	srv := startServer(t, NewWebSocketServer(Options{TracerProvider: provider, Dedup: true}))
+	a := dial(t, srv, "/ws")
+	b := dial(t, srv, "/ws")
+
+	for i := 0; i < 3; i++ {
+		a.send(map[string]string{"signalType": "candidate", "userId": b.id, "candidate": "c"})
+	}
+	if message := b.readType("candidate"); message["traceparent"] == nil {
+		t.Fatalf("forward lacks its trace context: %v", message)
+	}
+	b.expectNone(100 * time.Millisecond)
+}